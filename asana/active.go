@@ -0,0 +1,120 @@
+package asana
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/manishrjain/asanawarrior/x"
+)
+
+var active = flag.String("active", "",
+	"How a started Taskwarrior task is represented in Asana. One of \"tag:<name>\","+
+		" \"section:<name>\" or \"field:<enum field>=<option>\".")
+
+// activeRep is the Asana representation of an active task.
+type activeRep struct {
+	kind   string // tag, section or field.
+	name   string
+	option string
+}
+
+func parseActive() (activeRep, error) {
+	var a activeRep
+	if len(*active) == 0 {
+		return a, nil
+	}
+	kv := strings.SplitN(*active, ":", 2)
+	if len(kv) != 2 || len(kv[1]) == 0 {
+		return a, fmt.Errorf("Invalid active representation: %q", *active)
+	}
+	a.kind, a.name = kv[0], kv[1]
+	switch a.kind {
+	case "tag":
+	case "section":
+		a.name = cleanSection(a.name)
+	case "field":
+		fo := strings.SplitN(a.name, "=", 2)
+		if len(fo) != 2 || len(fo[1]) == 0 {
+			return a, fmt.Errorf("Active field should be of the form field:<name>=<option>. Got: %q",
+				*active)
+		}
+		a.name, a.option = fo[0], fo[1]
+	default:
+		return a, fmt.Errorf("Active representation should be tag, section or field. Got: %q",
+			a.kind)
+	}
+	return a, nil
+}
+
+// splitActive marks the task as started, if its Asana representation says so. Asana doesn't
+// track when the task was started, so the modification time is used instead.
+func splitActive(tsk task, wt *x.WarriorTask) {
+	a := cache.Active()
+	var started bool
+	switch a.kind {
+	case "tag":
+		var tags []string
+		for _, t := range wt.Tags {
+			if t == a.name {
+				started = true
+				continue
+			}
+			tags = append(tags, t)
+		}
+		wt.Tags = tags
+	case "section":
+		started = wt.Section == a.name
+	case "field":
+		for _, cf := range tsk.CustomFields {
+			if cf.Name == a.name && cf.EnumValue != nil && cf.EnumValue.Name == a.option {
+				started = true
+			}
+		}
+	}
+	if started {
+		wt.Started = wt.Modified
+	}
+}
+
+// withActive adds the tag representing the active state to tags, if the task is started.
+func withActive(wt x.WarriorTask, tags []string) []string {
+	if a := cache.Active(); a.kind == "tag" && !wt.Started.IsZero() {
+		tags = append(tags, a.name)
+	}
+	return tags
+}
+
+// updateActive adds the changes required to v, or to the section of tw, so Asana reflects
+// whether the task has been started or stopped in Taskwarrior.
+func updateActive(v url.Values, tw *x.WarriorTask, asana x.WarriorTask) {
+	started := !tw.Started.IsZero()
+	if started == !asana.Started.IsZero() {
+		return
+	}
+	a := cache.Active()
+	switch a.kind {
+	case "section":
+		if started {
+			tw.Section = a.name
+		} else if tw.Section == a.name {
+			tw.Section = ""
+		}
+	case "field":
+		cf, ok := cache.ActiveField()
+		if !ok {
+			return
+		}
+		var val string
+		if started {
+			for _, opt := range cf.EnumOptions {
+				if opt.Name == a.option {
+					val = strconv.FormatUint(opt.Id, 10)
+				}
+			}
+		}
+		v.Add(fmt.Sprintf("custom_fields[%d]", cf.Id), val)
+	}
+}
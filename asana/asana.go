@@ -2,6 +2,7 @@ package asana
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -9,6 +10,7 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -17,53 +19,210 @@ import (
 	"github.com/pkg/errors"
 )
 
-var token = flag.String("token", "", "Token provided by Asana.")
+var token = flag.String("token", "", "Token provided by Asana. Prefer setting "+tokenEnv+
+	", -token-file or -token-cmd instead, to keep it out of shell history.")
 var domain = flag.String("domain", "", "Workspace name, generally your domain name in Asana.")
 var verbose = flag.Bool("verbose", false, "Verbose output.")
+var projects = flag.String("projects", "",
+	"Comma separated list of Asana projects to sync. Syncs all projects in workspace if empty.")
+var requestTimeout = flag.Int("request-timeout", 120,
+	"Timeout in seconds for each request to Asana, including reading the response.")
 var cache *acache = new(acache)
 
+// client is shared by all requests to Asana, so connections get reused across requests.
+var client = &http.Client{
+	Transport: &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 20,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+}
+
+var errNoProject = errors.New("Member of no project")
+
 const (
 	prefix = "https://app.asana.com/api/1.0"
 	stamp  = "2006-01-02T15:04:05.999Z"
 )
 
-func runRequest(method, url string) ([]byte, error) {
+// taskFields are the fields we ask Asana to return for every task.
+var taskFields = []string{"assignee", "name", "tags", "completed_at", "modified_at",
+	"created_at", "dependencies", "custom_fields", "followers"}
+
+// Validate checks that the flags required by Asana have been set correctly.
+func Validate() error {
+	if len(*token) == 0 {
+		return errors.New("Asana token not set. Use -token, -token-file, -token-cmd, " +
+			tokenEnv + " or login")
+	}
+	if len(*domain) == 0 {
+		return errors.New("Asana domain not set")
+	}
+	if _, err := parseFields(); err != nil {
+		return err
+	}
+	if _, err := parsePriorityTags(); err != nil {
+		return err
+	}
+	if _, err := parseActive(); err != nil {
+		return err
+	}
+	if _, _, err := parseDeletePolicies(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// scope returns the names of the projects to be synced. Empty means all projects.
+func scope() map[string]bool {
+	m := make(map[string]bool)
+	for _, p := range strings.Split(*projects, ",") {
+		if p = strings.TrimSpace(p); len(p) > 0 {
+			m[p] = true
+		}
+	}
+	return m
+}
+
+// InScope returns true if the tasks in project are being synced.
+func InScope(project string) bool {
+	s := scope()
+	return len(s) == 0 || s[project]
+}
+
+// maxLimited is the number of times a rate limited request, or one failing with a server error, is
+// retried before giving up.
+const maxLimited = 5
+
+// serverError returns the error for a request which failed with a server error, or nil if the
+// request should be retried after a while. Requests which may have gone through aren't retried.
+func serverError(method, url string, code int, retry bool, failed *int) error {
+	err := x.Errorf(x.Unavailable, "method: [%v] url: [%v] status: [%v]", method, url,
+		http.StatusText(code))
+	*failed++
+	if !retry || *failed > maxLimited {
+		return err
+	}
+	log.Printf("%v. Retrying.", err)
+	return nil
+}
+
+// statusError returns a typed error for a response status, which retrying won't fix. Returns nil
+// for success, and for statuses which are worth retrying.
+func statusError(method, url string, code int) error {
+	msg := fmt.Sprintf("method: [%v] url: [%v] status: [%v]", method, url, http.StatusText(code))
+	switch {
+	case code == http.StatusUnauthorized, code == http.StatusForbidden:
+		return x.Errorf(x.Auth, "%s", msg)
+	case code == http.StatusNotFound:
+		return x.Errorf(x.NotFound, "%s", msg)
+	case code == http.StatusConflict:
+		return x.Errorf(x.Conflict, "%s", msg)
+	case code >= 400 && code < 500 && code != http.StatusTooManyRequests:
+		// Retrying won't help with client errors.
+		return errors.New(msg)
+	}
+	return nil
+}
+
+// backoff waits before retrying a rate limited request, as long as Asana asks for. Returns an
+// error if the request has been retried too many times already, or ctx is done.
+func backoff(ctx context.Context, resp *http.Response, limited *int) error {
+	*limited++
+	if *limited > maxLimited {
+		return x.Errorf(x.RateLimited, "method: [%v] url: [%v]", resp.Request.Method,
+			resp.Request.URL)
+	}
+	wait := 5 * time.Second
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+		wait = time.Duration(secs) * time.Second
+	}
+	return sleep(ctx, wait)
+}
+
+// sleep waits for d, unless ctx is done first.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// do sends the request using the shared client, and reads the response body. The whole exchange
+// must finish within -request-timeout.
+func do(ctx context.Context, req *http.Request) (*http.Response, []byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(*requestTimeout)*time.Second)
+	defer cancel()
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, nil, err
+	}
+	// Reading the body fully allows the connection to be reused.
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	return resp, body, err
+}
+
+func runRequest(ctx context.Context, method, url string) ([]byte, error) {
+	var limited, failed int
 RUNLOOP:
 	if *verbose {
 		fmt.Printf("METHOD: %v URL: %v\n", method, url)
 	}
 	req, err := http.NewRequest(method, url, nil)
 	if err != nil {
-		log.Fatal(err)
+		return nil, errors.Wrap(err, "runRequest http.NewRequest")
 	}
 
-	req.Header.Add("Authorization", "Bearer "+*token)
+	used := bearer()
+	req.Header.Add("Authorization", "Bearer "+used)
 	if *verbose {
 		fmt.Printf("HEADER: %+v\n", req.Header)
 	}
 
-	client := &http.Client{
-		Timeout: 10 * time.Minute,
-	}
-
-	resp, err := client.Do(req)
+	resp, body, err := do(ctx, req)
 	if err != nil {
+		if ctx.Err() != nil {
+			return nil, errors.Wrapf(ctx.Err(), "runRequest method: [%v] url: [%v]", method, url)
+		}
 		log.Printf("runRequest method: [%v] url: [%v] err: [%v]", method, url, err)
-		time.Sleep(5 * time.Second)
+		if err := sleep(ctx, 5*time.Second); err != nil {
+			return nil, err
+		}
 		goto RUNLOOP
 	}
 	code := resp.StatusCode
+	if code == http.StatusUnauthorized && refresh(ctx, used) {
+		goto RUNLOOP
+	}
+	if err := statusError(method, url, code); err != nil {
+		return nil, err
+	}
+	if code == http.StatusTooManyRequests {
+		if err := backoff(ctx, resp, &limited); err != nil {
+			return nil, err
+		}
+		goto RUNLOOP
+	}
 	if code != http.StatusOK {
-		log.Printf("runRequest method: [%v] url: [%v] status: [%v]",
-			method, url, http.StatusText(resp.StatusCode))
-		time.Sleep(5 * time.Second)
+		if err := serverError(method, url, code, true, &failed); err != nil {
+			return nil, err
+		}
+		if err := sleep(ctx, 5*time.Second); err != nil {
+			return nil, err
+		}
 		goto RUNLOOP
 	}
-	defer resp.Body.Close()
-	return ioutil.ReadAll(resp.Body)
+	return body, nil
 }
 
-func runGetter(i interface{}, suffix string, fields ...string) error {
+func runGetter(ctx context.Context, i interface{}, suffix string, fields ...string) error {
 	var url string
 	if len(fields) > 0 {
 		url = fmt.Sprintf("%s/%s?opt_fields=%s", prefix, suffix, strings.Join(fields, ","))
@@ -71,7 +230,7 @@ func runGetter(i interface{}, suffix string, fields ...string) error {
 		url = fmt.Sprintf("%s/%s", prefix, suffix)
 	}
 
-	body, err := runRequest("GET", url)
+	body, err := runRequest(ctx, "GET", url)
 	if err != nil {
 		return errors.Wrapf(err, "runGetter: %q", body)
 	}
@@ -93,14 +252,41 @@ type BasicDataOne struct {
 	Data Basic `json:"data"`
 }
 
-func getVarious(suffix string, opts ...string) ([]Basic, error) {
+func getVarious(ctx context.Context, suffix string, opts ...string) ([]Basic, error) {
 	var bd BasicData
-	if err := runGetter(&bd, suffix, opts...); err != nil {
+	if err := runGetter(ctx, &bd, suffix, opts...); err != nil {
 		return nil, err
 	}
 	return bd.Data, nil
 }
 
+// Whoami returns the email of the user the token belongs to.
+func Whoami(ctx context.Context) (string, error) {
+	var me BasicDataOne
+	if err := runGetter(ctx, &me, "users/me", "email"); err != nil {
+		return "", err
+	}
+	return me.Data.Email, nil
+}
+
+// Workspaces returns the names of all the workspaces accessible to the user.
+func Workspaces(ctx context.Context) ([]string, error) {
+	ws, err := getVarious(ctx, "workspaces", "name")
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, w := range ws {
+		names = append(names, w.Name)
+	}
+	return names, nil
+}
+
+// Domain returns the name of the workspace being synced.
+func Domain() string {
+	return *domain
+}
+
 type psec struct {
 	Project Basic `json:"project"`
 	Section Basic `json:"section"`
@@ -108,12 +294,15 @@ type psec struct {
 
 type task struct {
 	Basic
-	Assignee    Basic   `json:"assignee"`
-	Tags        []Basic `json:"tags"`
-	CompletedAt string  `json:"completed_at"`
-	ModifiedAt  string  `json:"modified_at"`
-	CreatedAt   string  `json:"created_at"`
-	Memberships []psec  `json:"memberships"`
+	Assignee     Basic         `json:"assignee"`
+	Tags         []Basic       `json:"tags"`
+	CompletedAt  string        `json:"completed_at"`
+	ModifiedAt   string        `json:"modified_at"`
+	CreatedAt    string        `json:"created_at"`
+	Dependencies []Basic       `json:"dependencies"`
+	Followers    []Basic       `json:"followers"`
+	Memberships  []psec        `json:"memberships"`
+	CustomFields []customField `json:"custom_fields"`
 }
 
 type tasks struct {
@@ -152,20 +341,37 @@ func convert(tsk task, proj, section string) (x.WarriorTask, error) {
 		Created:   cts,
 		Completed: dts,
 		Section:   section,
+		Fields:    toAttrs(tsk.CustomFields),
 	}
 	for _, tag := range tsk.Tags {
 		wt.Tags = append(wt.Tags, cache.Tag(tag.Id))
 	}
+	splitPriority(&wt)
+	splitActive(tsk, &wt)
+	if p, has := wt.Fields["priority"]; has {
+		wt.Priority = p
+		delete(wt.Fields, "priority")
+	}
+	for _, dep := range tsk.Dependencies {
+		wt.Depends = append(wt.Depends, dep.Id)
+	}
+	me := cache.Me()
+	for _, f := range tsk.Followers {
+		u := cache.User(f.Id)
+		wt.Followers = append(wt.Followers, u)
+		if u == me && wt.Assignee != me {
+			wt.Watching = true
+		}
+	}
 	return wt, nil
 }
 
-func getTasks(proj Basic, out chan x.WarriorTask, errc chan error) {
+func getTasks(ctx context.Context, proj Basic, out chan x.WarriorTask) error {
 	var sectionName string
 	var t tasks
-	if err := runGetter(&t, fmt.Sprintf("projects/%d/tasks", proj.Id),
-		"assignee,name,tags,completed_at,modified_at,created_at"); err != nil {
-		errc <- errors.Wrapf(err, "getTasks for project: %v", proj.Name)
-		return
+	if err := runGetter(ctx, &t, fmt.Sprintf("projects/%d/tasks", proj.Id),
+		taskFields...); err != nil {
+		return errors.Wrapf(err, "getTasks for project: %v", proj.Name)
 	}
 
 	for _, tsk := range t.Data {
@@ -184,24 +390,61 @@ func getTasks(proj Basic, out chan x.WarriorTask, errc chan error) {
 
 		wt, err := convert(tsk, proj.Name, sectionName)
 		if err != nil {
-			errc <- errors.Wrapf(err, "convert: getTasks for project: %v", proj.Name)
-			return
+			return errors.Wrapf(err, "convert: getTasks for project: %v", proj.Name)
 		}
 		out <- wt
 	}
-	errc <- nil
+	return nil
+}
+
+// Refresh updates the cached workspace, projects, tags and users. It must be called before
+// modifying tasks, unless GetTasks has been called.
+func Refresh(ctx context.Context) error {
+	return cache.update(ctx)
+}
+
+// FetchError is returned by GetTasks, when the tasks of some projects couldn't be fetched. The
+// tasks from the rest of the projects are still returned.
+type FetchError struct {
+	Failed map[string]error // By project name.
+}
+
+func (e *FetchError) Error() string {
+	var msgs []string
+	for name, err := range e.Failed {
+		msgs = append(msgs, fmt.Sprintf("%s: %v", name, err))
+	}
+	sort.Strings(msgs)
+	return "Unable to fetch tasks for projects: " + strings.Join(msgs, "; ")
 }
 
-func GetTasks() ([]x.WarriorTask, error) {
-	if err := cache.update(); err != nil {
+// Complete returns true if all the tasks in project were fetched.
+func (e *FetchError) Complete(project string) bool {
+	if e == nil {
+		return true
+	}
+	_, failed := e.Failed[project]
+	return !failed
+}
+
+// GetTasks returns the tasks in all the synced projects. If some projects fail, it returns the
+// rest of the tasks along with a *FetchError.
+func GetTasks(ctx context.Context) ([]x.WarriorTask, error) {
+	if err := cache.update(ctx); err != nil {
 		return nil, errors.Wrap(err, "cache.update")
 	}
 
+	type fetched struct {
+		project string
+		err     error
+	}
 	out := make(chan x.WarriorTask, 100)
 	projects := cache.Projects()
-	errc := make(chan error, len(projects))
+	errc := make(chan fetched, len(projects))
 	for _, proj := range projects {
-		go getTasks(proj, out, errc)
+		go func(proj Basic) {
+			errc <- fetched{proj.Name, getTasks(ctx, proj, out)}
+		}(proj)
 	}
 
 	// Asana can send back the same task multiple times, if it's part of multiple projects.
@@ -221,49 +464,90 @@ func GetTasks() ([]x.WarriorTask, error) {
 		done <- struct{}{}
 	}()
 
-	var rerr error
+	ferr := &FetchError{Failed: make(map[string]error)}
 	for _ = range projects {
-		if err := <-errc; err != nil {
-			rerr = err
+		if f := <-errc; f.err != nil {
+			ferr.Failed[f.project] = f.err
 		}
 	}
 	close(out)
 	<-done // Wait for all tasks to be picked up by goroutine.
-	return wtasks, rerr
+	if len(ferr.Failed) > 0 {
+		return wtasks, ferr
+	}
+	return wtasks, nil
 }
 
 // runPost would run a PUT or POST to Asana. No locks should be acquired.
-func runPost(method, suffix string, values url.Values) ([]byte, error) {
+func runPost(ctx context.Context, method, suffix string, values url.Values) ([]byte, error) {
+	return post(ctx, method, suffix, values, true)
+}
+
+// runCreate runs a POST which creates something in Asana. It isn't retried on network errors,
+// because the request might have gone through. The caller must check before trying again.
+func runCreate(ctx context.Context, suffix string, values url.Values) ([]byte, error) {
+	return post(ctx, "POST", suffix, values, false)
+}
+
+func post(ctx context.Context, method, suffix string, values url.Values,
+	retry bool) ([]byte, error) {
+
+	var limited, failed int
 POSTLOOP:
 	url := fmt.Sprintf("%s/%s", prefix, suffix)
 	fmt.Println(url, values.Encode())
 	req, err := http.NewRequest(method, url, bytes.NewBufferString(values.Encode()))
 	if err != nil {
-		log.Fatal(errors.Wrap(err, "runPost http.NewRequest"))
+		return nil, errors.Wrap(err, "runPost http.NewRequest")
 	}
 
-	req.Header.Add("Authorization", "Bearer "+*token)
+	used := bearer()
+	req.Header.Add("Authorization", "Bearer "+used)
 	req.Header.Add("content-type", "application/x-www-form-urlencoded")
-	client := &http.Client{
-		Timeout: 10 * time.Minute,
-	}
-	resp, err := client.Do(req)
+	resp, body, err := do(ctx, req)
 	if err != nil {
+		if ctx.Err() != nil {
+			return nil, errors.Wrapf(ctx.Err(), "runPost url: [%v]", url)
+		}
+		if !retry {
+			return nil, errors.Wrapf(err, "runPost url: [%v]", url)
+		}
 		log.Printf("runPost url: [%v] err: [%v]", url, err)
-		time.Sleep(5 * time.Second)
+		if err := sleep(ctx, 5*time.Second); err != nil {
+			return nil, err
+		}
 		goto POSTLOOP
 	}
-	defer resp.Body.Close()
-
-	return ioutil.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusUnauthorized && refresh(ctx, used) {
+		goto POSTLOOP
+	}
+	if err := statusError(method, url, resp.StatusCode); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		if err := backoff(ctx, resp, &limited); err != nil {
+			return nil, err
+		}
+		goto POSTLOOP
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		if err := serverError(method, url, resp.StatusCode, retry, &failed); err != nil {
+			return nil, err
+		}
+		if err := sleep(ctx, 5*time.Second); err != nil {
+			return nil, err
+		}
+		goto POSTLOOP
+	}
+	return body, nil
 }
 
-func toTagIds(tnames []string) []string {
+func toTagIds(ctx context.Context, tnames []string) []string {
 	var tags []string
 	for _, t := range tnames {
 		tid := cache.TagId(t)
 		if tid == 0 {
-			tid = cache.CreateTag(t)
+			tid = cache.CreateTag(ctx, t)
 			fmt.Printf("New Tag created. ID: %d", tid)
 		}
 		if tid > 0 {
@@ -273,27 +557,35 @@ func toTagIds(tnames []string) []string {
 	return tags
 }
 
-func removeProject(tid, pid uint64) error {
+func removeProject(ctx context.Context, tid, pid uint64) error {
 	v := url.Values{}
 	v.Add("project", strconv.FormatUint(pid, 10))
-	_, err := runPost("POST", fmt.Sprintf("tasks/%d/removeProject", tid), v)
+	_, err := runPost(ctx, "POST", fmt.Sprintf("tasks/%d/removeProject", tid), v)
 	return err
 }
 
-func updateSection(tid, pid uint64, section string) error {
+func updateSection(ctx context.Context, tid, pid uint64, section string) error {
+	return addProject(ctx, tid, pid, cache.SectionId(pid, section))
+}
+
+// addProject adds the task to the project, and to section sid if it's not zero.
+func addProject(ctx context.Context, tid, pid, sid uint64) error {
 	v := url.Values{}
 	v.Add("project", strconv.FormatUint(pid, 10))
-
-	sid := cache.SectionId(pid, section)
 	if sid > 0 {
 		v.Add("section", strconv.FormatUint(sid, 10))
 	}
 
-	_, err := runPost("POST", fmt.Sprintf("tasks/%d/addProject", tid), v)
+	_, err := runPost(ctx, "POST", fmt.Sprintf("tasks/%d/addProject", tid), v)
 	return err
 }
 
-func AddNew(wt x.WarriorTask) (x.WarriorTask, error) {
+// AddNew creates the task in Asana, and returns it as stored by Asana. If created isn't nil, it's
+// called with the id assigned by Asana as soon as the task exists, before setting the rest of its
+// attributes.
+func AddNew(ctx context.Context, wt x.WarriorTask,
+	created func(xid uint64)) (x.WarriorTask, error) {
+
 	e := x.WarriorTask{}
 
 	// Ensure that project actually exists before proceeding.
@@ -304,6 +596,8 @@ func AddNew(wt x.WarriorTask) (x.WarriorTask, error) {
 
 	v := url.Values{}
 	v.Add("workspace", strconv.FormatUint(cache.Workspace(), 10))
+	// Create it in the project right away, so it can be found if we don't get the response.
+	v.Add("projects", strconv.FormatUint(pid, 10))
 	v.Add("name", wt.Name)
 	aid := cache.UserId(wt.Assignee)
 	if aid > 0 {
@@ -312,12 +606,17 @@ func AddNew(wt x.WarriorTask) (x.WarriorTask, error) {
 	if !wt.Completed.IsZero() {
 		v.Add("completed", "true")
 	}
+	if wt.Watching {
+		if me := cache.UserId(cache.Me()); me > 0 {
+			v.Add("followers", strconv.FormatUint(me, 10))
+		}
+	}
 
-	tags := toTagIds(wt.Tags)
+	tags := toTagIds(ctx, withActive(wt, withPriority(wt)))
 	v.Add("tags", strings.Join(tags, ","))
-	resp, err := runPost("POST", "tasks", v)
+	resp, err := runCreate(ctx, "tasks", v)
 	if err != nil {
-		return e, errors.Wrap(err, "AddNew runPost")
+		return e, errors.Wrap(err, "AddNew runCreate")
 	}
 	fmt.Println(string(resp))
 
@@ -328,14 +627,30 @@ func AddNew(wt x.WarriorTask) (x.WarriorTask, error) {
 	if ot.Data.Id == 0 {
 		return e, fmt.Errorf("Unable to find ID assigned by Asana: %+v", ot.Data)
 	}
+	if created != nil {
+		created(ot.Data.Id)
+	}
 
-	// Now set the project and section.
-	if err := updateSection(ot.Data.Id, pid, wt.Section); err != nil {
+	// Custom fields can only be set once the task is part of the project.
+	v = url.Values{}
+	addFieldValues(v, wt, x.WarriorTask{})
+	updateActive(v, &wt, x.WarriorTask{})
+
+	// Now set the section.
+	if err := updateSection(ctx, ot.Data.Id, pid, wt.Section); err != nil {
 		return e, errors.Wrap(err, "AddNew updateSection")
 	}
+	if err := updateDepends(ctx, ot.Data.Id, wt.Depends, nil); err != nil {
+		return e, errors.Wrap(err, "AddNew updateDepends")
+	}
+	if len(v) > 0 {
+		if _, err := runPost(ctx, "PUT", "tasks/"+strconv.FormatUint(ot.Data.Id, 10), v); err != nil {
+			return e, errors.Wrap(err, "AddNew custom fields")
+		}
+	}
 
 	// Now retrieve the task back again so we can sync it up with TW.
-	return GetOneTask(ot.Data.Id)
+	return GetOneTask(ctx, ot.Data.Id)
 }
 
 func diff(t1 []string, t2 []string) []string {
@@ -353,11 +668,11 @@ func diff(t1 []string, t2 []string) []string {
 	return result
 }
 
-func updateOneTag(tagid, taskid, instruction string, errc chan error) {
+func updateOneTag(ctx context.Context, tagid, taskid, instruction string, errc chan error) {
 	v := url.Values{}
 	v.Add("tag", tagid)
 	suffix := fmt.Sprintf("tasks/%s/%s", taskid, instruction)
-	_, err := runPost("POST", suffix, v)
+	_, err := runPost(ctx, "POST", suffix, v)
 	if err != nil {
 		errc <- errors.Wrap(err, "updateTags")
 		return
@@ -365,21 +680,23 @@ func updateOneTag(tagid, taskid, instruction string, errc chan error) {
 	errc <- nil
 }
 
-func updateTags(tw x.WarriorTask, asana x.WarriorTask) error {
+func updateTags(ctx context.Context, tw x.WarriorTask, asana x.WarriorTask) error {
 	taskid := strconv.FormatUint(tw.Xid, 10)
-	add := diff(tw.Tags, asana.Tags)
-	rem := diff(asana.Tags, tw.Tags)
+	twtags := withActive(tw, withPriority(tw))
+	atags := withActive(asana, withPriority(asana))
+	add := diff(twtags, atags)
+	rem := diff(atags, twtags)
 
-	addids := toTagIds(add)
-	remids := toTagIds(rem)
+	addids := toTagIds(ctx, add)
+	remids := toTagIds(ctx, rem)
 	sz := len(addids) + len(remids)
 
 	errc := make(chan error, sz)
 	for _, id := range addids {
-		go updateOneTag(id, taskid, "addTag", errc)
+		go updateOneTag(ctx, id, taskid, "addTag", errc)
 	}
 	for _, id := range remids {
-		go updateOneTag(id, taskid, "removeTag", errc)
+		go updateOneTag(ctx, id, taskid, "removeTag", errc)
 	}
 
 	var rerr error
@@ -392,7 +709,71 @@ func updateTags(tw x.WarriorTask, asana x.WarriorTask) error {
 	return rerr
 }
 
-func UpdateTask(tw x.WarriorTask, asana x.WarriorTask) error {
+func toIds(xids []uint64) string {
+	ids := make([]string, 0, len(xids))
+	for _, xid := range xids {
+		ids = append(ids, strconv.FormatUint(xid, 10))
+	}
+	return strings.Join(ids, ",")
+}
+
+func diffIds(t1 []uint64, t2 []uint64) []uint64 {
+	m := make(map[uint64]bool)
+	for _, id := range t2 {
+		m[id] = true
+	}
+
+	var result []uint64
+	for _, id := range t1 {
+		if has := m[id]; !has {
+			result = append(result, id)
+		}
+	}
+	return result
+}
+
+// updateDepends sets the dependencies of task tid to want, given it currently has have.
+func updateDepends(ctx context.Context, tid uint64, want, have []uint64) error {
+	suffix := fmt.Sprintf("tasks/%d/", tid)
+	if add := diffIds(want, have); len(add) > 0 {
+		v := url.Values{}
+		v.Add("dependencies", toIds(add))
+		if _, err := runPost(ctx, "POST", suffix+"addDependencies", v); err != nil {
+			return errors.Wrap(err, "addDependencies")
+		}
+	}
+	if rem := diffIds(have, want); len(rem) > 0 {
+		v := url.Values{}
+		v.Add("dependencies", toIds(rem))
+		if _, err := runPost(ctx, "POST", suffix+"removeDependencies", v); err != nil {
+			return errors.Wrap(err, "removeDependencies")
+		}
+	}
+	return nil
+}
+
+// updateWatching adds or removes the user as a follower of the task, if they have started or
+// stopped watching it in Taskwarrior.
+func updateWatching(ctx context.Context, tw x.WarriorTask, asana x.WarriorTask) error {
+	if tw.Watching == asana.Watching {
+		return nil
+	}
+	me := cache.UserId(cache.Me())
+	if me == 0 {
+		return nil
+	}
+	instruction := "addFollowers"
+	if !tw.Watching {
+		instruction = "removeFollowers"
+	}
+	v := url.Values{}
+	v.Add("followers", strconv.FormatUint(me, 10))
+	_, err := runPost(ctx, "POST", fmt.Sprintf("tasks/%d/%s", tw.Xid, instruction), v)
+	return err
+}
+
+// changes returns the fields of the Asana task to update, so it matches Taskwarrior task tw.
+func changes(tw *x.WarriorTask, asana x.WarriorTask) url.Values {
 	v := url.Values{}
 	if tw.Name != asana.Name {
 		v.Add("name", tw.Name)
@@ -408,24 +789,54 @@ func UpdateTask(tw x.WarriorTask, asana x.WarriorTask) error {
 	} else if !asana.Completed.IsZero() && tw.Completed.IsZero() {
 		v.Add("completed", "false")
 	}
+	addFieldValues(v, *tw, asana)
+	updateActive(v, tw, asana)
+	return v
+}
 
+// Updated returns true if the Asana task already has all that UpdateTask would write from
+// Taskwarrior task tw, other than the dependencies.
+func Updated(tw x.WarriorTask, asana x.WarriorTask) bool {
+	if len(changes(&tw, asana)) > 0 {
+		return false
+	}
+	twtags := withActive(tw, withPriority(tw))
+	atags := withActive(asana, withPriority(asana))
+	if len(diff(twtags, atags)) > 0 || len(diff(atags, twtags)) > 0 {
+		return false
+	}
+	if tw.Watching != asana.Watching && cache.UserId(cache.Me()) > 0 {
+		return false
+	}
+	return cache.ProjectId(tw.Project) == 0 ||
+		(tw.Project == asana.Project && tw.Section == asana.Section)
+}
+
+func UpdateTask(ctx context.Context, tw x.WarriorTask, asana x.WarriorTask) error {
+	v := changes(&tw, asana)
 	if len(v) > 0 {
-		resp, err := runPost("PUT", "tasks/"+strconv.FormatUint(tw.Xid, 10), v)
+		resp, err := runPost(ctx, "PUT", "tasks/"+strconv.FormatUint(tw.Xid, 10), v)
 		if err != nil {
 			return errors.Wrap(err, "UpdateAsanaTask")
 		}
 		fmt.Println(string(resp))
 	}
 
-	if err := updateTags(tw, asana); err != nil {
+	if err := updateTags(ctx, tw, asana); err != nil {
 		return errors.Wrap(err, "asana.UpdateTask updateTags")
 	}
+	if err := updateDepends(ctx, tw.Xid, tw.Depends, asana.Depends); err != nil {
+		return errors.Wrap(err, "asana.UpdateTask updateDepends")
+	}
+	if err := updateWatching(ctx, tw, asana); err != nil {
+		return errors.Wrap(err, "asana.UpdateTask updateWatching")
+	}
 
 	// Update project or section if changed.
 	pid := cache.ProjectId(tw.Project)
 	if pid > 0 && (tw.Project != asana.Project || tw.Section != asana.Section) {
 		fmt.Printf("Updating project and section: %v %v\n", tw.Project, tw.Section)
-		if err := updateSection(tw.Xid, pid, tw.Section); err != nil {
+		if err := updateSection(ctx, tw.Xid, pid, tw.Section); err != nil {
 			return errors.Wrap(err, "asana.UpdateTask updateSection")
 		}
 		if tw.Project == asana.Project {
@@ -434,7 +845,7 @@ func UpdateTask(tw x.WarriorTask, asana x.WarriorTask) error {
 		// Project was changed. So, remove the last one.
 		fmt.Printf("Removing from project: %v\n", asana.Project)
 		if previd := cache.ProjectId(asana.Project); previd > 0 {
-			if err := removeProject(tw.Xid, previd); err != nil {
+			if err := removeProject(ctx, tw.Xid, previd); err != nil {
 				return err
 			}
 		}
@@ -442,24 +853,46 @@ func UpdateTask(tw x.WarriorTask, asana x.WarriorTask) error {
 	return nil
 }
 
-func GetOneTask(taskid uint64) (x.WarriorTask, error) {
+// GetOneTask fetches the task from Asana, as part of the first synced project it's in, if any.
+func GetOneTask(ctx context.Context, taskid uint64) (x.WarriorTask, error) {
 	e := x.WarriorTask{}
 	var ot oneTask
-	if err := runGetter(&ot, "tasks/"+strconv.FormatUint(taskid, 10)); err != nil {
+	fields := append(taskFields, "memberships.project.name", "memberships.section.name")
+	if err := runGetter(ctx, &ot, "tasks/"+strconv.FormatUint(taskid, 10), fields...); err != nil {
 		return e, errors.Wrap(err, "AddNew runGetter")
 	}
 
 	if len(ot.Data.Memberships) == 0 {
-		return e, errors.New("Member of no project")
+		return e, errNoProject
 	}
+	// The task can be in many projects. Prefer one which is synced.
 	member := ot.Data.Memberships[0]
+	for _, m := range ot.Data.Memberships {
+		if InScope(m.Project.Name) {
+			member = m
+			break
+		}
+	}
 
 	sname := cache.SectionName(member.Project.Id, member.Section.Id)
 	return convert(ot.Data, member.Project.Name, sname)
 }
 
-func Delete(taskid uint64) error {
+// Gone confirms with Asana that the task no longer exists in any of the synced projects, either
+// because it was deleted, or moved out of all of them.
+func Gone(ctx context.Context, taskid uint64) (bool, error) {
+	wt, err := GetOneTask(ctx, taskid)
+	switch {
+	case x.KindOf(err) == x.NotFound, errors.Cause(err) == errNoProject:
+		return true, nil
+	case err != nil:
+		return false, err
+	}
+	return !InScope(wt.Project), nil
+}
+
+func Delete(ctx context.Context, taskid uint64) error {
 	url := fmt.Sprintf("%s/tasks/%d", prefix, taskid)
-	_, err := runRequest("DELETE", url)
+	_, err := runRequest(ctx, "DELETE", url)
 	return err
 }
@@ -1,6 +1,7 @@
 package asana
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -9,6 +10,7 @@ import (
 	"strings"
 	"sync"
 
+	"github.com/manishrjain/asanawarrior/x"
 	"github.com/pkg/errors"
 )
 
@@ -23,13 +25,21 @@ type acache struct {
 	projects    []Basic
 	tags        []Basic
 	users       []Basic
+	me          string
 	tagmap      map[uint64]string
 	usermap     map[uint64]string
 	sections    map[uint64]*asection
+	fields      []customField
+	fieldmap    map[string]string
+	priotags    map[string]string
+	active      activeRep
+	activeField *customField
 }
 
 func printBasics(title string, bs []Basic) {
-	return // Avoid unnecessary output. Useful for debugging.
+	if !*verbose {
+		return // Avoid unnecessary output. Useful for debugging.
+	}
 
 	for _, b := range bs {
 		if len(b.Email) > 0 {
@@ -42,9 +52,9 @@ func printBasics(title string, bs []Basic) {
 }
 
 // updateTags updates the tags. Appropriate locks should be acquired by the caller.
-func (c *acache) updateTags() error {
+func (c *acache) updateTags(ctx context.Context) error {
 	var err error
-	c.tags, err = getVarious("tags", "name")
+	c.tags, err = getVarious(ctx, "tags", "name")
 	if err != nil {
 		return err
 	}
@@ -56,12 +66,12 @@ func (c *acache) updateTags() error {
 	return nil
 }
 
-func (c *acache) update() error {
+func (c *acache) update(ctx context.Context) error {
 	c.Lock()
 	defer c.Unlock()
 
 	var err error
-	c.workspaces, err = getVarious("workspaces", "name")
+	c.workspaces, err = getVarious(ctx, "workspaces", "name")
 	if err != nil {
 		return errors.Wrap(err, "workspaces")
 	}
@@ -72,20 +82,31 @@ func (c *acache) update() error {
 		}
 	}
 	if c.defaultWork == 0 {
-		log.Fatalf("Unable to find [%q] domain. Found: %+v", *domain, c.workspaces)
+		return x.Errorf(x.NotFound, "Unable to find [%q] domain. Found: %+v", *domain, c.workspaces)
 	}
 
-	c.projects, err = getVarious("workspaces/"+(strconv.Itoa(int(c.defaultWork)))+"/projects", "name")
+	c.projects, err = getVarious(ctx, "workspaces/"+(strconv.Itoa(int(c.defaultWork)))+"/projects", "name")
 	if err != nil {
 		return errors.Wrap(err, "projects")
 	}
+	if s := scope(); len(s) > 0 {
+		var found int
+		for _, p := range c.projects {
+			if s[p.Name] {
+				found++
+			}
+		}
+		if found < len(s) {
+			log.Printf("Some projects in %q not found in workspace", *projects)
+		}
+	}
 	printBasics("Project", c.projects)
 
-	if err := c.updateTags(); err != nil {
+	if err := c.updateTags(ctx); err != nil {
 		return errors.Wrap(err, "updateTags")
 	}
 
-	c.users, err = getVarious("users", "email")
+	c.users, err = getVarious(ctx, "users", "email")
 	if err != nil {
 		return errors.Wrap(err, "users")
 	}
@@ -99,7 +120,63 @@ func (c *acache) update() error {
 		c.usermap[u.Id] = u.Email
 	}
 	printBasics("User", c.users)
+
+	var me BasicDataOne
+	if err := runGetter(ctx, &me, "users/me", "email"); err != nil {
+		return errors.Wrap(err, "users/me")
+	}
+	c.me = strings.Split(me.Data.Email, "@")[0]
 	c.sections = make(map[uint64]*asection)
+
+	if err := c.updateFields(ctx); err != nil {
+		return errors.Wrap(err, "updateFields")
+	}
+	return nil
+}
+
+// updateFields updates the custom fields which are mapped to Taskwarrior attributes.
+// Appropriate locks should be acquired by the caller.
+func (c *acache) updateFields(ctx context.Context) error {
+	var err error
+	if c.fieldmap, err = parseFields(); err != nil {
+		return err
+	}
+	if len(*priorityField) > 0 {
+		c.fieldmap[*priorityField] = "priority"
+	}
+	if c.priotags, err = parsePriorityTags(); err != nil {
+		return err
+	}
+	if c.active, err = parseActive(); err != nil {
+		return err
+	}
+	c.fields = c.fields[:0]
+	c.activeField = nil
+	if len(c.fieldmap) == 0 && c.active.kind != "field" {
+		return nil
+	}
+
+	var cfs customFields
+	if err := runGetter(ctx, &cfs, fmt.Sprintf("workspaces/%d/custom_fields", c.defaultWork),
+		"name", "type", "enum_options.name"); err != nil {
+		return err
+	}
+	for _, cf := range cfs.Data {
+		if _, has := c.fieldmap[cf.Name]; has {
+			c.fields = append(c.fields, cf)
+		}
+		if c.active.kind == "field" && cf.Name == c.active.name {
+			f := cf
+			c.activeField = &f
+		}
+	}
+	if c.active.kind == "field" && c.activeField == nil {
+		log.Printf("Unable to find custom field %q to represent active tasks", c.active.name)
+	}
+	if len(c.fields) < len(c.fieldmap) {
+		log.Printf("Some custom fields in %+v not found in workspace. Found: %+v",
+			c.fieldmap, c.fields)
+	}
 	return nil
 }
 
@@ -109,11 +186,16 @@ func (c *acache) Workspace() uint64 {
 	return c.defaultWork
 }
 
+// Projects returns the projects being synced.
 func (c *acache) Projects() []Basic {
 	c.RLock()
 	defer c.RUnlock()
-	projects := make([]Basic, len(c.projects))
-	copy(projects, c.projects)
+	projects := make([]Basic, 0, len(c.projects))
+	for _, p := range c.projects {
+		if InScope(p.Name) {
+			projects = append(projects, p)
+		}
+	}
 	return projects
 }
 
@@ -134,6 +216,13 @@ func (c *acache) User(uid uint64) string {
 	return c.usermap[uid]
 }
 
+// Me returns the user the token belongs to.
+func (c *acache) Me() string {
+	c.RLock()
+	defer c.RUnlock()
+	return c.me
+}
+
 func (c *acache) UserId(email string) uint64 {
 	c.RLock()
 	defer c.RUnlock()
@@ -145,6 +234,58 @@ func (c *acache) UserId(email string) uint64 {
 	return 0
 }
 
+// Fields returns the custom fields, which are mapped to Taskwarrior attributes.
+func (c *acache) Fields() []customField {
+	c.RLock()
+	defer c.RUnlock()
+	fields := make([]customField, len(c.fields))
+	copy(fields, c.fields)
+	return fields
+}
+
+// FieldAttr returns the Taskwarrior attribute that custom field name is mapped to.
+func (c *acache) FieldAttr(name string) string {
+	c.RLock()
+	defer c.RUnlock()
+	return c.fieldmap[name]
+}
+
+// Active returns how an active task is represented in Asana.
+func (c *acache) Active() activeRep {
+	c.RLock()
+	defer c.RUnlock()
+	return c.active
+}
+
+// ActiveField returns the custom field used to represent active tasks, if any.
+func (c *acache) ActiveField() (customField, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	if c.activeField == nil {
+		return customField{}, false
+	}
+	return *c.activeField, true
+}
+
+// PriorityTag returns the Asana tag which represents Taskwarrior priority p.
+func (c *acache) PriorityTag(p string) string {
+	c.RLock()
+	defer c.RUnlock()
+	return c.priotags[p]
+}
+
+// TagPriority returns the Taskwarrior priority represented by Asana tag tname.
+func (c *acache) TagPriority(tname string) string {
+	c.RLock()
+	defer c.RUnlock()
+	for p, t := range c.priotags {
+		if t == tname {
+			return p
+		}
+	}
+	return ""
+}
+
 func (c *acache) Tag(uid uint64) string {
 	c.RLock()
 	defer c.RUnlock()
@@ -153,7 +294,7 @@ func (c *acache) Tag(uid uint64) string {
 
 func (c *acache) TagId(tname string) uint64 {
 	c.RLock()
-	c.RUnlock()
+	defer c.RUnlock()
 	for _, t := range c.tags {
 		if t.Name == tname {
 			return t.Id
@@ -162,7 +303,7 @@ func (c *acache) TagId(tname string) uint64 {
 	return 0
 }
 
-func (c *acache) CreateTag(tname string) uint64 {
+func (c *acache) CreateTag(ctx context.Context, tname string) uint64 {
 	c.Lock()
 	defer c.Unlock()
 
@@ -176,7 +317,7 @@ func (c *acache) CreateTag(tname string) uint64 {
 	v := url.Values{}
 	v.Add("workspace", strconv.FormatUint(c.defaultWork, 10))
 	v.Add("name", tname)
-	resp, err := runPost("POST", "tags", v)
+	resp, err := runPost(ctx, "POST", "tags", v)
 	if err != nil {
 		return 0
 	}
@@ -202,12 +343,7 @@ func (c *acache) AddSection(projId uint64, sec Basic) string {
 		return ""
 	}
 
-	sec.Name = strings.Map(func(r rune) rune {
-		if 'A' <= r && r <= 'Z' || 'a' <= r && r <= 'z' || '0' <= r && r <= '9' {
-			return r
-		}
-		return -1
-	}, sec.Name)
+	sec.Name = cleanSection(sec.Name)
 
 	for i := range s.list {
 		l := &s.list[i]
@@ -220,6 +356,17 @@ func (c *acache) AddSection(projId uint64, sec Basic) string {
 	return sec.Name
 }
 
+// cleanSection strips everything but letters and digits from section name, so it can be
+// used as a Taskwarrior tag.
+func cleanSection(name string) string {
+	return strings.Map(func(r rune) rune {
+		if 'A' <= r && r <= 'Z' || 'a' <= r && r <= 'z' || '0' <= r && r <= '9' {
+			return r
+		}
+		return -1
+	}, name)
+}
+
 func (c *acache) SectionName(projId uint64, secId uint64) string {
 	c.RLock()
 	defer c.RUnlock()
@@ -249,3 +396,23 @@ func (c *acache) SectionId(projId uint64, sectionName string) uint64 {
 	}
 	return 0
 }
+
+// CacheState is a copy of the cached workspace, projects, tags and users.
+type CacheState struct {
+	Workspace uint64  `json:"workspace"`
+	Projects  []Basic `json:"projects"`
+	Tags      []Basic `json:"tags"`
+	Users     []Basic `json:"users"`
+}
+
+// Cached returns a copy of the cache. Refresh must have been called before.
+func Cached() CacheState {
+	cache.RLock()
+	defer cache.RUnlock()
+	return CacheState{
+		Workspace: cache.defaultWork,
+		Projects:  append([]Basic(nil), cache.projects...),
+		Tags:      append([]Basic(nil), cache.tags...),
+		Users:     append([]Basic(nil), cache.users...),
+	}
+}
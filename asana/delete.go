@@ -0,0 +1,196 @@
+package asana
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/manishrjain/asanawarrior/x"
+	"github.com/pkg/errors"
+)
+
+var deletePolicy = flag.String("delete-policy", "hard",
+	"What to do in Asana, when a task is deleted in Taskwarrior. One of \"hard\" (delete),"+
+		" \"complete\", \"archive:<project>[/<section>]\" or \"tag:<name>\".")
+var deletePolicies = flag.String("delete-policies", "",
+	"Comma separated per project overrides of delete-policy. For e.g.:"+
+		" \"Team=archive:Archive/Old,Personal=hard\".")
+
+// policy is what to do in Asana when a task gets deleted in Taskwarrior.
+type policy struct {
+	kind    string // hard, complete, archive or tag.
+	project string
+	section string
+	tag     string
+}
+
+func (p policy) String() string {
+	switch p.kind {
+	case "archive":
+		if len(p.section) > 0 {
+			return fmt.Sprintf("archive to %s/%s", p.project, p.section)
+		}
+		return "archive to " + p.project
+	case "tag":
+		return "tag as " + p.tag
+	}
+	return p.kind
+}
+
+func parsePolicy(s string) (policy, error) {
+	var p policy
+	kv := strings.SplitN(strings.TrimSpace(s), ":", 2)
+	p.kind = kv[0]
+	switch p.kind {
+	case "hard", "complete":
+		if len(kv) == 2 {
+			return p, fmt.Errorf("Delete policy %q takes no argument: %q", p.kind, s)
+		}
+	case "archive":
+		if len(kv) != 2 || len(kv[1]) == 0 {
+			return p, fmt.Errorf("Archive policy needs a project: %q", s)
+		}
+		ps := strings.SplitN(kv[1], "/", 2)
+		p.project = ps[0]
+		if len(ps) == 2 {
+			p.section = ps[1]
+		}
+	case "tag":
+		if len(kv) != 2 || len(kv[1]) == 0 {
+			return p, fmt.Errorf("Tag policy needs a tag name: %q", s)
+		}
+		p.tag = kv[1]
+	default:
+		return p, fmt.Errorf("Delete policy should be hard, complete, archive or tag. Got: %q", s)
+	}
+	return p, nil
+}
+
+// parseDeletePolicies returns the default delete policy, and the per project overrides.
+func parseDeletePolicies() (policy, map[string]policy, error) {
+	def, err := parsePolicy(*deletePolicy)
+	if err != nil {
+		return def, nil, err
+	}
+	m := make(map[string]policy)
+	if len(*deletePolicies) == 0 {
+		return def, m, nil
+	}
+	for _, pair := range strings.Split(*deletePolicies, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || len(strings.TrimSpace(kv[0])) == 0 {
+			return def, nil, fmt.Errorf("Invalid per project delete policy: %q", pair)
+		}
+		p, err := parsePolicy(kv[1])
+		if err != nil {
+			return def, nil, err
+		}
+		m[strings.TrimSpace(kv[0])] = p
+	}
+	return def, m, nil
+}
+
+// policyFor returns the delete policy which applies to tasks in project.
+func policyFor(project string) policy {
+	def, m, err := parseDeletePolicies()
+	if err != nil {
+		// Validated at startup. Fall back to the safest option.
+		return policy{kind: "complete"}
+	}
+	if p, has := m[project]; has {
+		return p
+	}
+	return def
+}
+
+// archiveTo returns the ids of the archive project and section of the policy. The archive project
+// usually isn't synced, so its sections aren't cached, and it may have been created after the cache
+// was refreshed. Both are looked up in Asana, if not cached. The section id is zero if the policy
+// has no section.
+func archiveTo(ctx context.Context, p policy) (uint64, uint64, error) {
+	pid := cache.ProjectId(p.project)
+	if pid == 0 {
+		ps, err := getVarious(ctx, fmt.Sprintf("workspaces/%d/projects", cache.Workspace()),
+			"name")
+		if err != nil {
+			return 0, 0, errors.Wrap(err, "archive projects")
+		}
+		for _, pr := range ps {
+			if pr.Name == p.project {
+				pid = pr.Id
+			}
+		}
+	}
+	if pid == 0 {
+		return 0, 0, x.Errorf(x.NotFound, "Archive project not found in workspace: %v",
+			p.project)
+	}
+	if len(p.section) == 0 {
+		return pid, 0, nil
+	}
+
+	name := cleanSection(p.section)
+	if sid := cache.SectionId(pid, name); sid > 0 {
+		return pid, sid, nil
+	}
+	var t tasks
+	if err := runGetter(ctx, &t, fmt.Sprintf("projects/%d/tasks", pid), "name"); err != nil {
+		return 0, 0, errors.Wrap(err, "archive sections")
+	}
+	var sid uint64
+	for _, tsk := range t.Data {
+		if cache.AddSection(pid, tsk.Basic) == name && len(name) > 0 {
+			sid = tsk.Id
+		}
+	}
+	if sid == 0 {
+		return 0, 0, x.Errorf(x.NotFound, "Section %q not found in archive project %v",
+			p.section, p.project)
+	}
+	return pid, sid, nil
+}
+
+// Remove applies the delete policy of the task's project in Asana, and returns the policy applied.
+// Unless the policy is hard delete, the task continues to exist in Asana.
+func Remove(ctx context.Context, wt x.WarriorTask) (string, error) {
+	p := policyFor(wt.Project)
+	tid := strconv.FormatUint(wt.Xid, 10)
+	switch p.kind {
+	case "hard":
+		return p.String(), Delete(ctx, wt.Xid)
+
+	case "complete":
+		v := url.Values{}
+		v.Add("completed", "true")
+		_, err := runPost(ctx, "PUT", "tasks/"+tid, v)
+		return p.String(), err
+
+	case "archive":
+		aid, sid, err := archiveTo(ctx, p)
+		if err != nil {
+			return p.String(), err
+		}
+		if err := addProject(ctx, wt.Xid, aid, sid); err != nil {
+			return p.String(), errors.Wrap(err, "archive addProject")
+		}
+		if pid := cache.ProjectId(wt.Project); pid > 0 && pid != aid {
+			if err := removeProject(ctx, wt.Xid, pid); err != nil {
+				return p.String(), errors.Wrap(err, "archive removeProject")
+			}
+		}
+		return p.String(), nil
+
+	case "tag":
+		tags := toTagIds(ctx, []string{p.tag})
+		if len(tags) == 0 {
+			return p.String(), fmt.Errorf("Unable to find or create tag: %v", p.tag)
+		}
+		errc := make(chan error, 1)
+		updateOneTag(ctx, tags[0], tid, "addTag", errc)
+		return p.String(), <-errc
+	}
+	return p.String(), fmt.Errorf("Unknown delete policy: %v", p)
+}
@@ -0,0 +1,37 @@
+package asana
+
+import "testing"
+
+func TestParsePolicy(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    policy
+		wantErr bool
+	}{
+		{"hard", policy{kind: "hard"}, false},
+		{"complete", policy{kind: "complete"}, false},
+		{" complete ", policy{kind: "complete"}, false},
+		{"hard:x", policy{}, true},
+		{"archive:Archive", policy{kind: "archive", project: "Archive"}, false},
+		{"archive:Archive/Deleted", policy{kind: "archive", project: "Archive", section: "Deleted"},
+			false},
+		{"archive:Old/2017/Q1", policy{kind: "archive", project: "Old", section: "2017/Q1"}, false},
+		{"archive:", policy{}, true},
+		{"archive", policy{}, true},
+		{"tag:deleted", policy{kind: "tag", tag: "deleted"}, false},
+		{"tag:", policy{}, true},
+		{"tag", policy{}, true},
+		{"", policy{}, true},
+		{"bogus", policy{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parsePolicy(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parsePolicy(%q) error = %v, want error %v", tt.s, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got != tt.want {
+			t.Errorf("parsePolicy(%q) = %+v, want %+v", tt.s, got, tt.want)
+		}
+	}
+}
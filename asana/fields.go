@@ -0,0 +1,135 @@
+package asana
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/manishrjain/asanawarrior/x"
+	"github.com/pkg/errors"
+)
+
+var fields = flag.String("fields", "",
+	"Comma separated mapping of Asana custom fields to Taskwarrior attributes or UDAs."+
+		" For e.g.: \"Priority=priority,Estimate=estimate,Sprint=sprint\".")
+
+type customField struct {
+	Basic
+	Type        string   `json:"type"`
+	EnumValue   *Basic   `json:"enum_value"`
+	NumberValue *float64 `json:"number_value"`
+	TextValue   *string  `json:"text_value"`
+	EnumOptions []Basic  `json:"enum_options"`
+}
+
+type customFields struct {
+	Data []customField `json:"data"`
+}
+
+// parseFields parses the fields flag into a map from Asana custom field name to Taskwarrior
+// attribute.
+func parseFields() (map[string]string, error) {
+	m := make(map[string]string)
+	if len(*fields) == 0 {
+		return m, nil
+	}
+	for _, pair := range strings.Split(*fields, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || len(strings.TrimSpace(kv[0])) == 0 || len(strings.TrimSpace(kv[1])) == 0 {
+			return nil, fmt.Errorf("Invalid field mapping: %q", pair)
+		}
+		m[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return m, nil
+}
+
+// MappedAttrs returns the Taskwarrior attributes which Asana custom fields are mapped to.
+func MappedAttrs() []string {
+	m, err := parseFields()
+	if err != nil {
+		return nil
+	}
+	var attrs []string
+	for _, attr := range m {
+		attrs = append(attrs, attr)
+	}
+	return attrs
+}
+
+// enumValue converts the name of an Asana enum option to the value stored in Taskwarrior.
+// Taskwarrior priority only accepts H, M or L, so pick the first letter of option name.
+func enumValue(attr, name string) string {
+	if attr == "priority" && len(name) > 0 {
+		return strings.ToUpper(name[:1])
+	}
+	return name
+}
+
+// toAttrs converts the mapped custom fields of an Asana task to Taskwarrior attributes.
+func toAttrs(cfs []customField) map[string]string {
+	attrs := make(map[string]string)
+	for _, cf := range cfs {
+		attr := cache.FieldAttr(cf.Name)
+		if len(attr) == 0 {
+			continue
+		}
+		switch cf.Type {
+		case "enum":
+			if cf.EnumValue != nil {
+				attrs[attr] = enumValue(attr, cf.EnumValue.Name)
+			}
+		case "number":
+			if cf.NumberValue != nil {
+				attrs[attr] = strconv.FormatFloat(*cf.NumberValue, 'f', -1, 64)
+			}
+		case "text":
+			if cf.TextValue != nil && len(*cf.TextValue) > 0 {
+				attrs[attr] = *cf.TextValue
+			}
+		}
+	}
+	return attrs
+}
+
+// fromAttr converts a Taskwarrior attribute value to the value Asana expects for custom field cf.
+func fromAttr(cf customField, attr, val string) (string, error) {
+	if len(val) == 0 {
+		return "", nil
+	}
+	switch cf.Type {
+	case "enum":
+		for _, opt := range cf.EnumOptions {
+			if enumValue(attr, opt.Name) == val {
+				return strconv.FormatUint(opt.Id, 10), nil
+			}
+		}
+		return "", fmt.Errorf("No option %q found for field %q", val, cf.Name)
+	case "number":
+		if _, err := strconv.ParseFloat(val, 64); err != nil {
+			return "", errors.Wrapf(err, "field %q", cf.Name)
+		}
+		return val, nil
+	case "text":
+		return val, nil
+	}
+	return "", fmt.Errorf("Unsupported type %q for field %q", cf.Type, cf.Name)
+}
+
+// addFieldValues adds the custom fields which differ between tw and asana tasks to v.
+func addFieldValues(v url.Values, tw x.WarriorTask, asana x.WarriorTask) {
+	for _, cf := range cache.Fields() {
+		attr := cache.FieldAttr(cf.Name)
+		if attrValue(tw, attr) == attrValue(asana, attr) {
+			continue
+		}
+		val, err := fromAttr(cf, attr, attrValue(tw, attr))
+		if err != nil {
+			log.Printf("Unable to update custom field: %v", err)
+			continue
+		}
+		v.Add(fmt.Sprintf("custom_fields[%d]", cf.Id), val)
+	}
+}
@@ -0,0 +1,251 @@
+package asana
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	authorizeUrl = "https://app.asana.com/-/oauth_authorize"
+	tokenUrl     = "https://app.asana.com/-/oauth_token"
+	revokeUrl    = "https://app.asana.com/-/oauth_revoke"
+)
+
+var clientId = flag.String("client-id", "", "Client ID of the Asana app, for OAuth login.")
+var clientSecret = flag.String("client-secret", "",
+	"Client secret of the Asana app, for OAuth login.")
+var oauthPort = flag.Int("oauth-port", 8765,
+	"Local port to listen on for the OAuth redirect. The app's redirect URL must be"+
+		" http://localhost:<port>/callback.")
+
+// OAuthToken is the token granted by Asana via the OAuth authorization code flow.
+type OAuthToken struct {
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token"`
+	Expiry       time.Time `json:"expiry"`
+}
+
+// TokenStore persists the OAuth token across runs.
+type TokenStore interface {
+	LoadOAuth() (*OAuthToken, error)
+	SaveOAuth(t *OAuthToken) error
+	DeleteOAuth() error
+}
+
+// auth holds the OAuth token in use, if any, so it can be refreshed once it expires.
+var auth struct {
+	sync.Mutex
+	store TokenStore
+	oauth *OAuthToken
+}
+
+func redirectUrl() string {
+	return fmt.Sprintf("http://localhost:%d/callback", *oauthPort)
+}
+
+// bearer returns the token to authorize requests with.
+func bearer() string {
+	auth.Lock()
+	defer auth.Unlock()
+	return *token
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	Error        string `json:"error"`
+	Description  string `json:"error_description"`
+}
+
+// requestToken exchanges either the authorization code or refresh token for an access token.
+func requestToken(ctx context.Context, v url.Values) (*OAuthToken, error) {
+	v.Add("client_id", *clientId)
+	v.Add("client_secret", *clientSecret)
+	v.Add("redirect_uri", redirectUrl())
+	req, err := http.NewRequest("POST", tokenUrl, strings.NewReader(v.Encode()))
+	if err != nil {
+		return nil, errors.Wrap(err, "requestToken http.NewRequest")
+	}
+	req.Header.Add("content-type", "application/x-www-form-urlencoded")
+	_, body, err := do(ctx, req)
+	if err != nil {
+		return nil, errors.Wrap(err, "requestToken")
+	}
+	var tr tokenResponse
+	if err := json.Unmarshal(body, &tr); err != nil {
+		return nil, errors.Wrapf(err, "requestToken unmarshal: %q", body)
+	}
+	if len(tr.Error) > 0 || len(tr.AccessToken) == 0 {
+		return nil, fmt.Errorf("Unable to get token: %v %v", tr.Error, tr.Description)
+	}
+	return &OAuthToken{
+		AccessToken:  tr.AccessToken,
+		RefreshToken: tr.RefreshToken,
+		Expiry:       time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second),
+	}, nil
+}
+
+// UseOAuth picks the OAuth token from store, if no personal access token has been set.
+func UseOAuth(store TokenStore) error {
+	if len(*token) > 0 {
+		return nil
+	}
+	t, err := store.LoadOAuth()
+	if err != nil || t == nil {
+		return err
+	}
+	auth.Lock()
+	defer auth.Unlock()
+	auth.store = store
+	auth.oauth = t
+	*token = t.AccessToken
+	return nil
+}
+
+// UsingOAuth returns true if the token is an OAuth access token.
+func UsingOAuth() bool {
+	auth.Lock()
+	defer auth.Unlock()
+	return auth.oauth != nil
+}
+
+// refresh gets a new access token, if the one used for a request has expired. Returns true if
+// the request should be retried.
+func refresh(ctx context.Context, used string) bool {
+	auth.Lock()
+	defer auth.Unlock()
+	if auth.oauth == nil {
+		return false
+	}
+	if *token != used {
+		// Already refreshed by another request.
+		return true
+	}
+
+	v := url.Values{}
+	v.Add("grant_type", "refresh_token")
+	v.Add("refresh_token", auth.oauth.RefreshToken)
+	t, err := requestToken(ctx, v)
+	if err != nil {
+		fmt.Printf("Unable to refresh OAuth token: %v\n", err)
+		return false
+	}
+	if len(t.RefreshToken) == 0 {
+		// Asana doesn't always hand out a new refresh token.
+		t.RefreshToken = auth.oauth.RefreshToken
+	}
+	if err := auth.store.SaveOAuth(t); err != nil {
+		fmt.Printf("Unable to save refreshed OAuth token: %v\n", err)
+	}
+	auth.oauth = t
+	*token = t.AccessToken
+	return true
+}
+
+func randomState() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Login runs the OAuth authorization code flow. It asks the user to open the authorization
+// URL, waits for Asana to redirect back to a local listener, and stores the granted token.
+func Login(ctx context.Context, store TokenStore) error {
+	if len(*clientId) == 0 || len(*clientSecret) == 0 {
+		return errors.New("Both -client-id and -client-secret are required for login")
+	}
+	state, err := randomState()
+	if err != nil {
+		return errors.Wrap(err, "Login state")
+	}
+	ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", *oauthPort))
+	if err != nil {
+		return errors.Wrap(err, "Login listen")
+	}
+	defer ln.Close()
+
+	codec := make(chan string, 1)
+	errc := make(chan error, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/callback", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		switch {
+		case q.Get("state") != state:
+			http.Error(w, "Invalid state.", http.StatusBadRequest)
+			errc <- errors.New("OAuth state mismatch")
+		case len(q.Get("error")) > 0:
+			http.Error(w, "Authorization denied.", http.StatusForbidden)
+			errc <- fmt.Errorf("Authorization denied: %v", q.Get("error"))
+		default:
+			fmt.Fprintln(w, "Asanawarrior is now authorized. You can close this window.")
+			codec <- q.Get("code")
+		}
+	})
+	go http.Serve(ln, mux)
+
+	v := url.Values{}
+	v.Add("client_id", *clientId)
+	v.Add("redirect_uri", redirectUrl())
+	v.Add("response_type", "code")
+	v.Add("state", state)
+	fmt.Printf("Open this URL in your browser to authorize Asanawarrior:\n\n%s?%s\n\n",
+		authorizeUrl, v.Encode())
+
+	var code string
+	select {
+	case code = <-codec:
+	case err := <-errc:
+		return err
+	case <-time.After(5 * time.Minute):
+		return errors.New("Timed out waiting for authorization")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	v = url.Values{}
+	v.Add("grant_type", "authorization_code")
+	v.Add("code", code)
+	t, err := requestToken(ctx, v)
+	if err != nil {
+		return err
+	}
+	return store.SaveOAuth(t)
+}
+
+// Logout revokes the stored OAuth token, and removes it from store.
+func Logout(ctx context.Context, store TokenStore) error {
+	t, err := store.LoadOAuth()
+	if err != nil {
+		return err
+	}
+	if t != nil && len(*clientId) > 0 && len(*clientSecret) > 0 {
+		v := url.Values{}
+		v.Add("client_id", *clientId)
+		v.Add("client_secret", *clientSecret)
+		v.Add("token", t.RefreshToken)
+		req, err := http.NewRequest("POST", revokeUrl, strings.NewReader(v.Encode()))
+		if err != nil {
+			return errors.Wrap(err, "Logout http.NewRequest")
+		}
+		req.Header.Add("content-type", "application/x-www-form-urlencoded")
+		if _, _, err := do(ctx, req); err != nil {
+			fmt.Printf("Unable to revoke token: %v\n", err)
+		}
+	}
+	return store.DeleteOAuth()
+}
@@ -0,0 +1,66 @@
+package asana
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/manishrjain/asanawarrior/x"
+)
+
+var priorityField = flag.String("priority-field", "",
+	"Name of Asana custom enum field to map Taskwarrior priority to.")
+var priorityTags = flag.String("priority-tags", "",
+	"Comma separated mapping of Taskwarrior priority to Asana tags, used if no priority field"+
+		" is set. For e.g.: \"H=urgent,M=soon,L=someday\".")
+
+// parsePriorityTags parses the priority-tags flag into a map from priority to Asana tag.
+func parsePriorityTags() (map[string]string, error) {
+	m := make(map[string]string)
+	if len(*priorityTags) == 0 || len(*priorityField) > 0 {
+		return m, nil
+	}
+	for _, pair := range strings.Split(*priorityTags, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || len(strings.TrimSpace(kv[1])) == 0 {
+			return nil, fmt.Errorf("Invalid priority tag mapping: %q", pair)
+		}
+		p := strings.ToUpper(strings.TrimSpace(kv[0]))
+		if p != "H" && p != "M" && p != "L" {
+			return nil, fmt.Errorf("Priority should be one of H, M or L. Got: %q", pair)
+		}
+		m[p] = strings.TrimSpace(kv[1])
+	}
+	return m, nil
+}
+
+// attrValue returns the value of Taskwarrior attribute attr for the task.
+func attrValue(wt x.WarriorTask, attr string) string {
+	if attr == "priority" {
+		return wt.Priority
+	}
+	return wt.Fields[attr]
+}
+
+// splitPriority picks the priority out of the Asana tags of a task, if priority is
+// represented by tags.
+func splitPriority(wt *x.WarriorTask) {
+	var tags []string
+	for _, t := range wt.Tags {
+		if p := cache.TagPriority(t); len(p) > 0 {
+			wt.Priority = p
+			continue
+		}
+		tags = append(tags, t)
+	}
+	wt.Tags = tags
+}
+
+// withPriority returns the Asana tags of the task, including the tag representing its priority.
+func withPriority(wt x.WarriorTask) []string {
+	tags := append([]string{}, wt.Tags...)
+	if t := cache.PriorityTag(wt.Priority); len(t) > 0 {
+		tags = append(tags, t)
+	}
+	return tags
+}
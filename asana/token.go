@@ -0,0 +1,64 @@
+package asana
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// tokenEnv is the environment variable the token is read from, if not passed as a flag.
+const tokenEnv = "ASANA_TOKEN"
+
+var tokenFile = flag.String("token-file", "",
+	"File containing the Asana token. Must not be readable by others.")
+var tokenCmd = flag.String("token-cmd", "",
+	"Command which prints the Asana token, for e.g. \"pass show asana\".")
+
+// readTokenFile reads the token from path, refusing to do so if the file is world-readable.
+func readTokenFile(path string) (string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", errors.Wrap(err, "token file")
+	}
+	if fi.Mode().Perm()&0004 != 0 {
+		return "", fmt.Errorf("Token file %v is world-readable. Run: chmod 600 %v", path, path)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", errors.Wrap(err, "token file")
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// LoadToken sets the token, if it wasn't passed via the token flag. It is picked from the
+// environment, the token file, or the output of the token command, in that order.
+func LoadToken() error {
+	if len(*token) > 0 {
+		return nil
+	}
+	if t := os.Getenv(tokenEnv); len(t) > 0 {
+		*token = t
+		return nil
+	}
+	if len(*tokenFile) > 0 {
+		t, err := readTokenFile(*tokenFile)
+		if err != nil {
+			return err
+		}
+		*token = t
+		return nil
+	}
+	if len(*tokenCmd) > 0 {
+		out, err := exec.Command("bash", "-c", *tokenCmd).Output()
+		if err != nil {
+			return errors.Wrapf(err, "token command %q", *tokenCmd)
+		}
+		*token = strings.TrimSpace(string(out))
+	}
+	return nil
+}
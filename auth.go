@@ -0,0 +1,24 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/manishrjain/asanawarrior/asana"
+)
+
+func login(ctx context.Context) error {
+	if err := asana.Login(ctx, db); err != nil {
+		return err
+	}
+	fmt.Println("Logged in. Asanawarrior will use this authorization for syncing.")
+	return nil
+}
+
+func logout(ctx context.Context) error {
+	if err := asana.Logout(ctx, db); err != nil {
+		return err
+	}
+	fmt.Println("Logged out.")
+	return nil
+}
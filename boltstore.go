@@ -0,0 +1,705 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/manishrjain/asanawarrior/asana"
+	"github.com/manishrjain/asanawarrior/taskwarrior"
+	"github.com/manishrjain/asanawarrior/x"
+	"github.com/pkg/errors"
+)
+
+// Version 1 of the bolt schema stored the modification times of tasks as of their last sync under
+// asana-<xid> and taskw-<uuid> keys in the aw bucket. The link between the two lived only in
+// Taskwarrior's xid.
+//
+// Version 2 stores a mapping per linked task, keyed by Asana id, with an index by UUID.
+var metaBucket = []byte("meta")
+var mappingBucket = []byte("mappings")
+var uuidBucket = []byte("uuids")
+var versionKey = []byte("version")
+
+var legacyBucket = []byte("aw")
+
+// The journal records every sync run, and every action applied during a run.
+var runsBucket = []byte("journal-runs")
+var actionsBucket = []byte("journal-actions")
+
+// Deletions beyond -deletes in a single sync are held in quarantine.
+var quarantineBucket = []byte("quarantine")
+
+// Intents of sync actions in flight.
+var intentsBucket = []byte("intents")
+
+var oauthBucket = []byte("oauth")
+var oauthKey = []byte("token")
+
+// stateBuckets are replaced on import.
+var stateBuckets = [][]byte{mappingBucket, uuidBucket, runsBucket, actionsBucket,
+	quarantineBucket, intentsBucket}
+
+// boltStore keeps the sync state in a bolt db. Only one process can have it open at a time.
+type boltStore struct {
+	db        *bolt.DB
+	path      string
+	suspended bool
+}
+
+// openBoltDb opens the bolt db at path, waiting up to -lock-timeout for any other process to
+// close it.
+func openBoltDb(path string) (*bolt.DB, error) {
+	timeout := time.Duration(*lockTimeout) * time.Second
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: timeout})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("In use by another asanawarrior%s. Timed out after %v waiting"+
+			" for it to finish syncing. Try again, or use -store sqlite, which can be read"+
+			" during a sync", heldBy(*lockPath), timeout)
+	}
+	return db, err
+}
+
+func openBolt(path string) (*boltStore, error) {
+	db, err := openBoltDb(path)
+	if err != nil {
+		return nil, err
+	}
+	return &boltStore{db: db, path: path}, nil
+}
+
+func (s *boltStore) Suspend() error {
+	if s.suspended {
+		return nil
+	}
+	s.suspended = true
+	return s.db.Close()
+}
+
+func (s *boltStore) Resume() error {
+	if !s.suspended {
+		return nil
+	}
+	db, err := openBoltDb(s.path)
+	if err != nil {
+		return err
+	}
+	s.db, s.suspended = db, false
+	return nil
+}
+
+func itob(i uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, i)
+	return b
+}
+
+func btoi(b []byte) uint64 {
+	return binary.BigEndian.Uint64(b)
+}
+
+func (s *boltStore) Close() error {
+	if s.suspended {
+		return nil
+	}
+	return s.db.Close()
+}
+
+// migrations upgrade the db from the version they're keyed by, to the next version.
+var migrations = map[int]func(tx *bolt.Tx) error{
+	1: migrateLegacy,
+}
+
+func dbVersion(tx *bolt.Tx) (int, error) {
+	if b := tx.Bucket(metaBucket); b != nil {
+		v, err := strconv.Atoi(string(b.Get(versionKey)))
+		if err != nil {
+			return 0, x.Errorf(x.Corrupt, "Invalid schema version: %q", b.Get(versionKey))
+		}
+		return v, nil
+	}
+	if tx.Bucket(legacyBucket) != nil {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func setVersion(tx *bolt.Tx, v int) error {
+	b, err := tx.CreateBucketIfNotExists(metaBucket)
+	if err != nil {
+		return err
+	}
+	return b.Put(versionKey, []byte(strconv.Itoa(v)))
+}
+
+// createSchema creates the buckets of the current schema, in an empty db.
+func createSchema(tx *bolt.Tx) error {
+	for _, name := range [][]byte{mappingBucket, uuidBucket} {
+		if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func legacyTs(b *bolt.Bucket, key string) (time.Time, bool) {
+	val := b.Get([]byte(key))
+	if val == nil {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339, string(val))
+	return t, err == nil
+}
+
+// migrateLegacy creates a mapping for every Taskwarrior task linked to Asana, which has both
+// timestamps in the aw bucket. Tasks without them get overwritten from Asana on the next sync.
+func migrateLegacy(tx *bolt.Tx) error {
+	tasks, err := taskwarrior.GetTasks()
+	if err != nil {
+		return errors.Wrap(err, "Taskwarrior is needed to migrate the db")
+	}
+	count, err := migrateLegacyTasks(tx, tasks)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Migrated %d tasks to db schema version 2.\n", count)
+	return nil
+}
+
+// migrateLegacyTasks moves the legacy timestamps of the Taskwarrior tasks given to mappings, and
+// drops the aw bucket. Returns the number of tasks migrated.
+func migrateLegacyTasks(tx *bolt.Tx, tasks []x.WarriorTask) (int, error) {
+	old := tx.Bucket(legacyBucket)
+	if err := createSchema(tx); err != nil {
+		return 0, err
+	}
+	var count int
+	for _, t := range tasks {
+		if t.Xid == 0 {
+			continue
+		}
+		at, ok := legacyTs(old, fmt.Sprintf("asana-%d", t.Xid))
+		if !ok {
+			continue
+		}
+		tt, ok := legacyTs(old, "taskw-"+t.Uuid)
+		if !ok {
+			continue
+		}
+		t := t
+		mp := &mapping{Xid: t.Xid, Uuid: t.Uuid, AsanaTs: at, TaskwTs: tt, Synced: tt,
+			Last: snapshot{Taskw: &t}}
+		if err := putMapping(tx, mp); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, tx.DeleteBucket(legacyBucket)
+}
+
+func (s *boltStore) Version() (int, error) {
+	var v int
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		v, err = dbVersion(tx)
+		return err
+	})
+	return v, err
+}
+
+// Migrate backs up the db before migrating any existing data.
+func (s *boltStore) Migrate() error {
+	v, err := s.Version()
+	if err != nil {
+		return err
+	}
+	if v == schemaVersion {
+		return nil
+	}
+	if v > schemaVersion {
+		return fmt.Errorf("Db schema version %d is newer than supported version %d. Please upgrade",
+			v, schemaVersion)
+	}
+	if v > 0 {
+		backup := fmt.Sprintf("%s.v%d.bak", s.path, v)
+		if err := s.db.View(func(tx *bolt.Tx) error {
+			return tx.CopyFile(backup, 0600)
+		}); err != nil {
+			return errors.Wrap(err, "Unable to backup db")
+		}
+		fmt.Printf("Migrating db from schema version %d to %d. Backup saved at %v.\n",
+			v, schemaVersion, backup)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if v == 0 {
+			// Empty db. Create it at the current version.
+			if err := createSchema(tx); err != nil {
+				return err
+			}
+			return setVersion(tx, schemaVersion)
+		}
+		for ; v < schemaVersion; v++ {
+			if err := migrations[v](tx); err != nil {
+				return errors.Wrapf(err, "Migrating db from version %d", v)
+			}
+		}
+		return setVersion(tx, schemaVersion)
+	})
+}
+
+func (s *boltStore) Backup() (string, error) {
+	backup := fmt.Sprintf("%s.%s.bak", s.path, time.Now().Format("20060102T150405"))
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(backup, 0600)
+	}); err != nil {
+		return "", errors.Wrap(err, "Unable to backup db")
+	}
+	return backup, nil
+}
+
+func getMapping(tx *bolt.Tx, xid uint64) (*mapping, error) {
+	val := tx.Bucket(mappingBucket).Get(itob(xid))
+	if val == nil {
+		return nil, nil
+	}
+	mp := new(mapping)
+	if err := json.Unmarshal(val, mp); err != nil {
+		return nil, x.Errorf(x.Corrupt, "Invalid mapping for %d: %v", xid, err)
+	}
+	return mp, nil
+}
+
+func putMapping(tx *bolt.Tx, mp *mapping) error {
+	mb, ub := tx.Bucket(mappingBucket), tx.Bucket(uuidBucket)
+	if prev, err := getMapping(tx, mp.Xid); err == nil && prev != nil && prev.Uuid != mp.Uuid {
+		if err := ub.Delete([]byte(prev.Uuid)); err != nil {
+			return err
+		}
+	}
+	if xid := ub.Get([]byte(mp.Uuid)); xid != nil && !bytes.Equal(xid, itob(mp.Xid)) {
+		if err := mb.Delete(xid); err != nil {
+			return err
+		}
+	}
+	val, err := json.Marshal(mp)
+	if err != nil {
+		return err
+	}
+	if err := mb.Put(itob(mp.Xid), val); err != nil {
+		return err
+	}
+	return ub.Put([]byte(mp.Uuid), itob(mp.Xid))
+}
+
+func (s *boltStore) GetMapping(xid uint64) (*mapping, error) {
+	var mp *mapping
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		mp, err = getMapping(tx, xid)
+		return err
+	})
+	return mp, err
+}
+
+func (s *boltStore) PutMapping(mp *mapping) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putMapping(tx, mp)
+	})
+}
+
+func (s *boltStore) DeleteMapping(xid uint64, uuid string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		mb, ub := tx.Bucket(mappingBucket), tx.Bucket(uuidBucket)
+		if prev, err := getMapping(tx, xid); err == nil && prev != nil {
+			if err := ub.Delete([]byte(prev.Uuid)); err != nil {
+				return err
+			}
+		}
+		if prev := ub.Get([]byte(uuid)); prev != nil {
+			if err := mb.Delete(prev); err != nil {
+				return err
+			}
+		}
+		if err := mb.Delete(itob(xid)); err != nil {
+			return err
+		}
+		return ub.Delete([]byte(uuid))
+	})
+}
+
+func (s *boltStore) Mappings() ([]mapping, error) {
+	var result []mapping
+	err := s.db.View(func(tx *bolt.Tx) error {
+		ub := tx.Bucket(uuidBucket)
+		return tx.Bucket(mappingBucket).ForEach(func(k, v []byte) error {
+			mp, err := getMapping(tx, btoi(k))
+			if err != nil {
+				return err
+			}
+			if xid := ub.Get([]byte(mp.Uuid)); !bytes.Equal(xid, k) {
+				return x.Errorf(x.Corrupt, "uuid %v not indexed to xid %d", mp.Uuid, mp.Xid)
+			}
+			result = append(result, *mp)
+			return nil
+		})
+	})
+	return result, err
+}
+
+func (s *boltStore) NextRun() (uint64, error) {
+	var id uint64
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(runsBucket)
+		if err != nil {
+			return err
+		}
+		id, err = b.NextSequence()
+		return err
+	})
+	return id, err
+}
+
+func (s *boltStore) SaveRun(r *syncStats) error {
+	val, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(runsBucket)
+		if err != nil {
+			return err
+		}
+		return b.Put(itob(r.Id), val)
+	})
+}
+
+func (s *boltStore) Runs() ([]syncStats, error) {
+	var runs []syncStats
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(runsBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var r syncStats
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			runs = append(runs, r)
+			return nil
+		})
+	})
+	return runs, err
+}
+
+func (s *boltStore) RecentRuns(fn func(r *syncStats) bool) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(runsBucket)
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var r syncStats
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			if !fn(&r) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) Prune(id uint64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(runsBucket); b != nil {
+			var keys [][]byte
+			c := b.Cursor()
+			for k, _ := c.First(); k != nil && btoi(k) < id; k, _ = c.Next() {
+				keys = append(keys, k)
+			}
+			for _, k := range keys {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+		b := tx.Bucket(actionsBucket)
+		if b == nil {
+			return nil
+		}
+		// Entries are recorded in the order of their runs.
+		var keys [][]byte
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var e entry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			if e.Run >= id {
+				break
+			}
+			keys = append(keys, k)
+		}
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) AddEntry(e *entry) error {
+	val, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(actionsBucket)
+		if err != nil {
+			return err
+		}
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		return b.Put(itob(seq), val)
+	})
+}
+
+func (s *boltStore) Entries(keep func(e *entry) bool) ([]*entry, error) {
+	var entries []*entry
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(actionsBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			e := new(entry)
+			if err := json.Unmarshal(v, e); err != nil {
+				return err
+			}
+			if keep(e) {
+				entries = append(entries, e)
+			}
+			return nil
+		})
+	})
+	return entries, err
+}
+
+func (s *boltStore) Held() (map[string]*held, error) {
+	result := make(map[string]*held)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(quarantineBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			h := new(held)
+			if err := json.Unmarshal(v, h); err != nil {
+				return err
+			}
+			result[h.Key] = h
+			return nil
+		})
+	})
+	return result, err
+}
+
+func putHeld(tx *bolt.Tx, hs []*held) error {
+	b, err := tx.CreateBucketIfNotExists(quarantineBucket)
+	if err != nil {
+		return err
+	}
+	for _, h := range hs {
+		val, err := json.Marshal(h)
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte(h.Key), val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *boltStore) PutHeld(hs ...*held) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putHeld(tx, hs)
+	})
+}
+
+func (s *boltStore) DeleteHeld(keys ...string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(quarantineBucket)
+		if b == nil {
+			return nil
+		}
+		for _, k := range keys {
+			if err := b.Delete([]byte(k)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) Intents() ([]*intent, error) {
+	var ins []*intent
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(intentsBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			in := new(intent)
+			if err := json.Unmarshal(v, in); err != nil {
+				return err
+			}
+			ins = append(ins, in)
+			return nil
+		})
+	})
+	return ins, err
+}
+
+func (s *boltStore) PutIntent(in *intent) error {
+	val, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(intentsBucket)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(in.Key), val)
+	})
+}
+
+func (s *boltStore) DeleteIntent(key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(intentsBucket)
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(key))
+	})
+}
+
+func (s *boltStore) Reset() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{mappingBucket, uuidBucket} {
+			if err := tx.DeleteBucket(name); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+		return createSchema(tx)
+	})
+}
+
+func (s *boltStore) Replace(st *state) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range stateBuckets {
+			if err := tx.DeleteBucket(name); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+		if err := createSchema(tx); err != nil {
+			return err
+		}
+		for i := range st.Mappings {
+			if err := putMapping(tx, &st.Mappings[i]); err != nil {
+				return err
+			}
+		}
+
+		rb, err := tx.CreateBucket(runsBucket)
+		if err != nil {
+			return err
+		}
+		var last uint64
+		for _, r := range st.Runs {
+			val, err := json.Marshal(r)
+			if err != nil {
+				return err
+			}
+			if err := rb.Put(itob(r.Id), val); err != nil {
+				return err
+			}
+			if r.Id > last {
+				last = r.Id
+			}
+		}
+		if err := rb.SetSequence(last); err != nil {
+			return err
+		}
+
+		ab, err := tx.CreateBucket(actionsBucket)
+		if err != nil {
+			return err
+		}
+		for _, e := range st.Actions {
+			val, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			seq, err := ab.NextSequence()
+			if err != nil {
+				return err
+			}
+			if err := ab.Put(itob(seq), val); err != nil {
+				return err
+			}
+		}
+		return putHeld(tx, st.Quarantine)
+	})
+}
+
+func (s *boltStore) LoadOAuth() (*asana.OAuthToken, error) {
+	var t *asana.OAuthToken
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(oauthBucket)
+		if b == nil {
+			return nil
+		}
+		val := b.Get(oauthKey)
+		if val == nil {
+			return nil
+		}
+		t = new(asana.OAuthToken)
+		return json.Unmarshal(val, t)
+	})
+	return t, errors.Wrap(err, "LoadOAuth")
+}
+
+func (s *boltStore) SaveOAuth(t *asana.OAuthToken) error {
+	val, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(oauthBucket)
+		if err != nil {
+			return err
+		}
+		return b.Put(oauthKey, val)
+	})
+}
+
+func (s *boltStore) DeleteOAuth() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(oauthBucket) == nil {
+			return nil
+		}
+		return tx.DeleteBucket(oauthBucket)
+	})
+}
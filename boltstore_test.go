@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/manishrjain/asanawarrior/x"
+)
+
+func TestMigrateLegacy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "asanawarrior")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bdb, err := bolt.Open(filepath.Join(dir, "legacy.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bdb.Close()
+
+	ats, tts := "2017-03-01T10:00:00Z", "2017-03-02T11:00:00Z"
+	legacy := map[string]string{
+		// Both timestamps.
+		"asana-1":  ats,
+		"taskw-u1": tts,
+		// No Taskwarrior timestamp.
+		"asana-2": ats,
+		// No Asana timestamp.
+		"taskw-u3": tts,
+		// Invalid timestamp.
+		"asana-4":  "yesterday",
+		"taskw-u4": tts,
+		// Task no longer linked in Taskwarrior.
+		"asana-5":  ats,
+		"taskw-u5": tts,
+	}
+	if err := bdb.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket(legacyBucket)
+		if err != nil {
+			return err
+		}
+		for k, v := range legacy {
+			if err := b.Put([]byte(k), []byte(v)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := bdb.View(func(tx *bolt.Tx) error {
+		v, err := dbVersion(tx)
+		if v != 1 {
+			t.Errorf("dbVersion of legacy db = %d, want 1", v)
+		}
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	tasks := []x.WarriorTask{
+		{Xid: 1, Uuid: "u1", Name: "migrated"},
+		{Xid: 2, Uuid: "u2"},
+		{Xid: 3, Uuid: "u3"},
+		{Xid: 4, Uuid: "u4"},
+		{Uuid: "u5"},
+	}
+	if err := bdb.Update(func(tx *bolt.Tx) error {
+		count, err := migrateLegacyTasks(tx, tasks)
+		if count != 1 {
+			t.Errorf("migrated %d tasks, want 1", count)
+		}
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	wantA, _ := time.Parse(time.RFC3339, ats)
+	wantT, _ := time.Parse(time.RFC3339, tts)
+	if err := bdb.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(legacyBucket) != nil {
+			t.Error("legacy bucket not dropped")
+		}
+		mp, err := getMapping(tx, 1)
+		if err != nil {
+			return err
+		}
+		switch {
+		case mp == nil:
+			t.Fatal("no mapping for task 1")
+		case mp.Uuid != "u1" || !mp.AsanaTs.Equal(wantA) || !mp.TaskwTs.Equal(wantT):
+			t.Errorf("mapping = %+v, want u1 with %v and %v", mp, wantA, wantT)
+		case mp.Last.Taskw == nil || mp.Last.Taskw.Name != "migrated":
+			t.Errorf("last synced state = %+v, want the Taskwarrior task", mp.Last.Taskw)
+		}
+		for _, xid := range []uint64{2, 3, 4, 5} {
+			if mp, err := getMapping(tx, xid); err != nil || mp != nil {
+				t.Errorf("task %d: mapping = %+v, err = %v, want none", xid, mp, err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
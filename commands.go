@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/0xAX/notificator"
+	"github.com/manishrjain/asanawarrior/asana"
+	"github.com/pkg/errors"
+)
+
+type command struct {
+	name  string
+	usage string
+	asana bool // Needs a valid Asana configuration to run.
+	lock  bool // Modifies the db, Asana or Taskwarrior. Only one instance can run it at a time.
+	run   func(ctx context.Context, args []string) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"daemon", "Sync right away, and then every -dur minutes. Default if no command is given.",
+			true, true, runDaemon},
+		{"sync", "Same as daemon. With --once, sync once and exit, for e.g. from cron.",
+			true, true, runSyncCmd},
+		{"status", "Show results of the last sync, and the changes and conflicts pending.",
+			true, false, runStatus},
+		{"doctor", "Validate the token, workspace, Taskwarrior UDAs and the db.", false, false,
+			runDoctor},
+		{"history", "Show past sync runs, or actions filtered by -task, -since, -until, -action" +
+			" or -run.", false, false, runHistory},
+		{"undo", "Revert the actions of the last sync run, or the one set by -run. Supports" +
+			" -dry-run.", true, false, runUndo},
+		{"quarantine", "List deletions held back by -deletes. Approve or reject them with" +
+			" -approve or -reject, and task ids or -all.", false, false, runQuarantine},
+		{"relink", "Repair links between Taskwarrior and Asana tasks, or link -uuid to -xid." +
+			" Supports -dry-run.", true, false, runRelink},
+		{"export", "Write the sync state as JSON to the file given.", true, false, runExport},
+		{"import", "Replace the sync state with the file given, after validating it. Supports" +
+			" -dry-run and -force.", true, true, runImport},
+		{"reset", "Clear the sync state stored in db. Asana wins on the next sync.", false, true,
+			runReset},
+		{"hook", "Run as the Taskwarrior on-add and on-modify hook, to notify the daemon of" +
+			" changed tasks. See hooks/.", false, false, runHook},
+		{"login", "Authorize Asanawarrior via OAuth.", false, true, runLogin},
+		{"logout", "Revoke and remove the OAuth authorization.", false, true, runLogout},
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags] [command] [command flags]\n\nCommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", c.name, c.usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+func findCommand(name string) (command, bool) {
+	for _, c := range commands {
+		if c.name == name {
+			return c, true
+		}
+	}
+	return command{}, false
+}
+
+// confirm asks the user a yes/no question on the terminal.
+func confirm(question string) bool {
+	fmt.Printf("%s [y/N]: ", question)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+func syncNow(ctx context.Context, t time.Time) *syncStats {
+	fmt.Println()
+	fmt.Println("Starting sync at", t)
+	return runSync(ctx)
+}
+
+// withDb runs fn with the db open. The daemon suspends the db between syncs, so other commands
+// can read it.
+func withDb(fn func()) {
+	if err := db.Resume(); err != nil {
+		log.Printf("Unable to reopen db. Skipping this sync: %v", err)
+		return
+	}
+	fn()
+	if err := db.Suspend(); err != nil {
+		log.Printf("Unable to suspend db: %v", err)
+	}
+}
+
+func runDaemon(ctx context.Context, args []string) error {
+	notify = notificator.New(notificator.Options{
+		AppName: "Asanawarrior",
+	})
+	quit, flushed := make(chan struct{}), make(chan struct{})
+	// Flags are only read and set on this goroutine. A new -interval is passed on, on reload.
+	intervals := make(chan int)
+	go processNotifications(*notifyInterval, intervals, quit, flushed)
+	defer func() {
+		close(quit)
+		<-flushed
+	}()
+	reload, trigger := daemonSignals()
+
+	// Hear of tasks changed in Taskwarrior from the hooks, and sync them once no more changes
+	// come in for -debounce seconds.
+	var changed <-chan string
+	if len(*socketPath) > 0 {
+		l, ch, err := listenHooks(*socketPath)
+		if err != nil {
+			return errors.Wrapf(err, "Unable to listen on %v", *socketPath)
+		}
+		defer l.Close()
+		changed = ch
+	}
+	pending := make(map[string]bool)
+	settle := time.NewTimer(time.Hour)
+	stopSettle := func() {
+		if !settle.Stop() {
+			select {
+			case <-settle.C:
+			default:
+			}
+		}
+	}
+	stopSettle()
+	defer settle.Stop()
+	// full syncs all the tasks, including the changed ones.
+	full := func(t time.Time) {
+		stopSettle()
+		pending = make(map[string]bool)
+		withDb(func() { syncNow(ctx, t) })
+	}
+
+	// Initiate a sync right away.
+	withDb(func() { syncNow(ctx, time.Now()) })
+
+	// And then do it at regular intervals, until shut down.
+	ticker := time.NewTicker(time.Duration(*duration) * time.Minute)
+	defer func() {
+		ticker.Stop()
+	}()
+	for !shuttingDown() {
+		select {
+		case t := <-ticker.C:
+			full(t)
+		case <-trigger:
+			full(time.Now())
+		case uuid := <-changed:
+			pending[uuid] = true
+			stopSettle()
+			settle.Reset(time.Duration(*debounce) * time.Second)
+		case <-settle.C:
+			if lastFetch.IsZero() {
+				fmt.Printf("Leaving %d changed tasks for the first full sync.\n", len(pending))
+				break
+			}
+			var uuids []string
+			for uuid := range pending {
+				uuids = append(uuids, uuid)
+			}
+			pending = make(map[string]bool)
+			withDb(func() { syncChanged(ctx, uuids) })
+		case <-reload:
+			reloadConfig()
+			intervals <- *notifyInterval
+			ticker.Stop()
+			ticker = time.NewTicker(time.Duration(*duration) * time.Minute)
+		case <-stopping:
+		}
+	}
+	fmt.Println("Shutting down.")
+	return nil
+}
+
+// reloadConfig applies the config file again, on SIGHUP. Takes effect from the next sync. If the
+// config file or the token it points to can't be loaded, the last config is kept.
+func reloadConfig() {
+	fmt.Println("Reloading config file:", *configPath)
+	saved := saveFlags()
+	err := loadConfig()
+	if err == nil {
+		err = reloadToken()
+	}
+	if err == nil {
+		err = asana.Validate()
+	}
+	if err != nil {
+		saved.restore()
+		log.Printf("Unable to reload config. Keeping the last one. Error: %v", err)
+	}
+}
+
+// reloadToken loads the token again, so a changed token-file or token-cmd takes effect. A token
+// passed on the command line, or from OAuth, is kept.
+func reloadToken() error {
+	if !cmdline["token"] && !fromConfig["token"] && !asana.UsingOAuth() {
+		flag.Set("token", "")
+	}
+	return asana.LoadToken()
+}
+
+func runSyncCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	once := fs.Bool("once", false, "Sync once and exit.")
+	fs.Parse(args)
+	if !*once {
+		return runDaemon(ctx, fs.Args())
+	}
+
+	stats := syncNow(ctx, time.Now())
+	if len(stats.Errors) > 0 {
+		return fmt.Errorf("Sync finished with %d errors", len(stats.Errors))
+	}
+	return nil
+}
+
+func runReset(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("reset", flag.ExitOnError)
+	yes := fs.Bool("yes", false, "Don't ask for confirmation.")
+	fs.Parse(args)
+
+	if !*yes && !confirm(fmt.Sprintf("Clear all sync state stored in %v?", *dbpath)) {
+		fmt.Println("Aborted.")
+		return nil
+	}
+	backup, err := db.Backup()
+	if err != nil {
+		return err
+	}
+
+	if err := db.Reset(); err != nil {
+		return errors.Wrap(err, "Unable to reset db")
+	}
+	fmt.Printf("Sync state cleared. Backup saved at %v.\n", backup)
+	fmt.Println("On the next sync, tasks present in both get overwritten in Taskwarrior from Asana.")
+	return nil
+}
+
+func runLogin(ctx context.Context, args []string) error {
+	return login(ctx)
+}
+
+func runLogout(ctx context.Context, args []string) error {
+	return logout(ctx)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+)
+
+var configPath = flag.String("config",
+	filepath.Join(os.Getenv("HOME"), ".config", "asanawarrior", "config.toml"),
+	"Path to config file. Flags passed on the command line override values in the file.")
+var profile = flag.String("profile", "",
+	"Name of the profile to use from config file. Defaults to the profile set in the file.")
+
+// config is the layout of the config file. Each profile maps flag names to their values. For e.g.
+//
+//	profile = "work"
+//
+//	[profiles.work]
+//	token-cmd = "pass show asana"
+//	domain = "example.com"
+//	projects = ["Engineering", "Design"]
+//	deletes = 10
+//
+//	[profiles.work.fields]
+//	Priority = "priority"
+//	Estimate = "estimate"
+type config struct {
+	Profile  string                            `toml:"profile"`
+	Profiles map[string]map[string]interface{} `toml:"profiles"`
+}
+
+// secretKeys are the flags which hold credentials. A config file setting them mustn't be
+// world-readable.
+var secretKeys = []string{"token", "client-secret"}
+
+// checkSecrets refuses a world-readable config file, if any of its profiles sets credentials.
+func checkSecrets(c config) error {
+	var found []string
+	for name, values := range c.Profiles {
+		for _, key := range secretKeys {
+			if _, has := values[key]; has {
+				found = append(found, name+"."+key)
+			}
+		}
+	}
+	if len(found) == 0 {
+		return nil
+	}
+	fi, err := os.Stat(*configPath)
+	if err != nil {
+		return errors.Wrap(err, "config file")
+	}
+	if fi.Mode().Perm()&0004 != 0 {
+		sort.Strings(found)
+		return fmt.Errorf("Config file %v sets %s, but is world-readable. Run: chmod 600 %v",
+			*configPath, strings.Join(found, ", "), *configPath)
+	}
+	return nil
+}
+
+// flagValue converts a value from the config file, to the string representation its flag expects.
+// Lists are comma separated, and tables are comma separated key=value pairs.
+func flagValue(v interface{}) (string, error) {
+	switch val := v.(type) {
+	case string:
+		return val, nil
+	case int64, float64, bool:
+		return fmt.Sprint(val), nil
+	case []interface{}:
+		var parts []string
+		for _, item := range val {
+			s, err := flagValue(item)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, s)
+		}
+		return strings.Join(parts, ","), nil
+	case map[string]interface{}:
+		var parts []string
+		for k, item := range val {
+			s, err := flagValue(item)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, k+"="+s)
+		}
+		sort.Strings(parts)
+		return strings.Join(parts, ","), nil
+	}
+	return "", fmt.Errorf("unsupported value type %T", v)
+}
+
+// savedFlags holds the values of all the flags, to restore them if reloading the config fails.
+type savedFlags struct {
+	values     map[string]string
+	fromConfig map[string]bool
+}
+
+func saveFlags() savedFlags {
+	s := savedFlags{values: make(map[string]string), fromConfig: fromConfig}
+	flag.VisitAll(func(f *flag.Flag) {
+		s.values[f.Name] = f.Value.String()
+	})
+	return s
+}
+
+func (s savedFlags) restore() {
+	for name, v := range s.values {
+		flag.Set(name, v)
+	}
+	fromConfig = s.fromConfig
+}
+
+// cmdline has the flags explicitly set on the command line, and fromConfig the flags set from
+// the config file, so it can be reloaded.
+var cmdline, fromConfig map[string]bool
+
+// loadConfig applies the values from the selected profile in config file, to all the flags
+// which weren't explicitly set on the command line. Not having a config file is fine. When called
+// again, flags no longer present in the config file go back to their defaults.
+func loadConfig() error {
+	if cmdline == nil {
+		cmdline = make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) {
+			cmdline[f.Name] = true
+		})
+	}
+	for name := range fromConfig {
+		flag.Set(name, flag.Lookup(name).DefValue)
+	}
+	fromConfig = make(map[string]bool)
+
+	var c config
+	if _, err := toml.DecodeFile(*configPath, &c); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "Unable to parse config file: %v", *configPath)
+	}
+	if err := checkSecrets(c); err != nil {
+		return err
+	}
+
+	name := *profile
+	if len(name) == 0 {
+		name = c.Profile
+	}
+	if len(name) == 0 {
+		name = "default"
+	}
+	values, has := c.Profiles[name]
+	if !has {
+		if len(*profile) == 0 && len(c.Profile) == 0 {
+			return nil
+		}
+		return fmt.Errorf("Profile %q not found in config file: %v", name, *configPath)
+	}
+
+	var errs []string
+	for key, v := range values {
+		if key == "config" || key == "profile" || flag.Lookup(key) == nil {
+			errs = append(errs, fmt.Sprintf("unknown key %q", key))
+			continue
+		}
+		if cmdline[key] {
+			continue
+		}
+		s, err := flagValue(v)
+		if err == nil {
+			err = flag.Set(key, s)
+			fromConfig[key] = true
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("invalid value for %q: %v", key, err))
+		}
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("Profile %q in config file %v has errors:\n\t%s",
+			name, *configPath, strings.Join(errs, "\n\t"))
+	}
+	return nil
+}
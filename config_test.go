@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFlagValue(t *testing.T) {
+	tests := []struct {
+		name    string
+		v       interface{}
+		want    string
+		wantErr bool
+	}{
+		{"string", "~/.task/asanawarrior.db", "~/.task/asanawarrior.db", false},
+		{"empty string", "", "", false},
+		{"int", int64(300), "300", false},
+		{"float", 1.5, "1.5", false},
+		{"bool", true, "true", false},
+		{"list", []interface{}{"Work", "Home"}, "Work,Home", false},
+		{"empty list", []interface{}{}, "", false},
+		{"map", map[string]interface{}{"Work": "work", "Home": "home"}, "Home=home,Work=work",
+			false},
+		{"list of ints", []interface{}{int64(1), int64(2)}, "1,2", false},
+		{"unsupported", int32(1), "", true},
+		{"unsupported in list", []interface{}{"a", nil}, "", true},
+		{"unsupported in map", map[string]interface{}{"a": []int{1}}, "", true},
+	}
+	for _, tt := range tests {
+		got, err := flagValue(tt.v)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: flagValue(%v) error = %v, want error %v", tt.name, tt.v, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: flagValue(%v) = %q, want %q", tt.name, tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "asanawarrior")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Unsetenv("ASANA_TOKEN")
+	path := filepath.Join(dir, "config.toml")
+	flag.Set("config", path)
+	defer flag.Set("config", flag.Lookup("config").DefValue)
+
+	tests := []struct {
+		name      string
+		config    string
+		wantToken string
+		wantCmd   string
+	}{
+		{"first", "domain = \"example.com\"\ntoken-cmd = \"echo one\"", "one", "echo one"},
+		{"token-cmd changed", "domain = \"example.com\"\ntoken-cmd = \"echo two\"", "two",
+			"echo two"},
+		{"invalid file", "domain = \"example.com\"\ntoken-cmd = ", "two", "echo two"},
+		{"token-cmd fails", "domain = \"example.com\"\ntoken-cmd = \"false\"", "two", "echo two"},
+		{"invalid value", "domain = \"example.com\"\ntoken-cmd = \"echo three\"\nworkers = \"x\"",
+			"two", "echo two"},
+		{"no token", "domain = \"example.com\"", "two", "echo two"},
+	}
+	for _, tt := range tests {
+		data := "[profiles.default]\n" + tt.config + "\n"
+		if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		reloadConfig()
+		token, cmd := flag.Lookup("token").Value.String(), flag.Lookup("token-cmd").Value.String()
+		if token != tt.wantToken || cmd != tt.wantCmd {
+			t.Errorf("%s: token = %q, token-cmd = %q, want %q, %q", tt.name, token, cmd,
+				tt.wantToken, tt.wantCmd)
+		}
+	}
+	for name := range fromConfig {
+		flag.Set(name, flag.Lookup(name).DefValue)
+	}
+	fromConfig = nil
+	flag.Set("token", "")
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/manishrjain/asanawarrior/x"
+)
+
+// depends tracks the Asana xid <-> Taskwarrior uuid mapping of all the tasks being synced, along
+// with the dependency graph as present in Asana. Taskwarrior refers to dependencies by UUIDs,
+// while Asana uses its own ids; so dependencies must be translated using this mapping. It's safe
+// for concurrent use by the sync workers.
+type depends struct {
+	sync.RWMutex
+	uuids map[uint64]string
+	xids  map[string]uint64
+	graph map[uint64][]uint64
+}
+
+func newDepends(atasks []x.WarriorTask, twtasks []x.WarriorTask) *depends {
+	d := &depends{
+		uuids: make(map[uint64]string),
+		xids:  make(map[string]uint64),
+		graph: make(map[uint64][]uint64),
+	}
+	for _, tw := range twtasks {
+		if tw.Xid > 0 {
+			d.link(tw.Xid, tw.Uuid)
+		}
+	}
+	for _, at := range atasks {
+		d.graph[at.Xid] = at.Depends
+	}
+	return d
+}
+
+// link records that Asana task xid corresponds to Taskwarrior task uuid.
+func (d *depends) link(xid uint64, uuid string) {
+	d.Lock()
+	defer d.Unlock()
+	d.uuids[xid] = uuid
+	d.xids[uuid] = xid
+}
+
+// set updates the dependency graph, after dependencies for xid were modified in Asana.
+func (d *depends) set(xid uint64, deps []uint64) {
+	d.Lock()
+	defer d.Unlock()
+	d.graph[xid] = deps
+}
+
+// toUuids converts Asana ids to Taskwarrior UUIDs. Tasks not present in Taskwarrior are skipped.
+func (d *depends) toUuids(xids []uint64) []string {
+	d.RLock()
+	defer d.RUnlock()
+	var uuids []string
+	for _, xid := range xids {
+		if uuid, ok := d.uuids[xid]; ok {
+			uuids = append(uuids, uuid)
+		}
+	}
+	return uuids
+}
+
+// toXids converts Taskwarrior UUIDs to Asana ids. Tasks not present in Asana are skipped.
+func (d *depends) toXids(uuids []string) []uint64 {
+	d.RLock()
+	defer d.RUnlock()
+	var xids []uint64
+	for _, uuid := range uuids {
+		if xid, ok := d.xids[uuid]; ok {
+			xids = append(xids, xid)
+		}
+	}
+	return xids
+}
+
+// reaches returns true if task to can be reached from task from, by following dependencies.
+func (d *depends) reaches(from, to uint64, seen map[uint64]bool) bool {
+	if from == to {
+		return true
+	}
+	if seen[from] {
+		return false
+	}
+	seen[from] = true
+	for _, dep := range d.graph[from] {
+		if d.reaches(dep, to, seen) {
+			return true
+		}
+	}
+	return false
+}
+
+// acyclic returns the dependencies from deps, which can be set on task xid without causing
+// a dependency cycle. Dependencies which would, get dropped.
+func (d *depends) acyclic(xid uint64, deps []uint64) []uint64 {
+	d.RLock()
+	defer d.RUnlock()
+	var result []uint64
+	for _, dep := range deps {
+		if xid > 0 && d.reaches(dep, xid, make(map[uint64]bool)) {
+			fmt.Printf("Ignoring dependency of %d on %d: it would cause a cycle\n", xid, dep)
+			continue
+		}
+		result = append(result, dep)
+	}
+	return result
+}
+
+// forAsana returns the dependencies of Taskwarrior task tw as Asana ids. Dependencies in Asana
+// on tasks which Taskwarrior doesn't know about, are retained.
+func (d *depends) forAsana(tw, asana x.WarriorTask) []uint64 {
+	deps := d.toXids(tw.DependsUuid)
+	d.RLock()
+	for _, dep := range asana.Depends {
+		if _, ok := d.uuids[dep]; !ok {
+			deps = append(deps, dep)
+		}
+	}
+	d.RUnlock()
+	return d.acyclic(tw.Xid, deps)
+}
+
+// forTaskwarrior returns the Asana ids xids as UUIDs, to set as the dependencies of Taskwarrior
+// task tw. Dependencies in Taskwarrior on tasks which Asana doesn't know about, are retained.
+func (d *depends) forTaskwarrior(xids []uint64, tw x.WarriorTask) []string {
+	uuids := d.toUuids(xids)
+	d.RLock()
+	for _, uuid := range tw.DependsUuid {
+		if _, ok := d.xids[uuid]; !ok {
+			uuids = append(uuids, uuid)
+		}
+	}
+	d.RUnlock()
+	return uuids
+}
+
+// merged returns the union of dependencies from both Asana and Taskwarrior. This is useful to
+// pick up dependencies which couldn't be translated, because the other side didn't have the
+// corresponding task at the time.
+func (d *depends) merged(asana, tw x.WarriorTask) []uint64 {
+	deps := append([]uint64{}, asana.Depends...)
+	for _, dep := range d.toXids(tw.DependsUuid) {
+		if !contains(deps, dep) {
+			deps = append(deps, dep)
+		}
+	}
+	return d.acyclic(asana.Xid, deps)
+}
+
+func contains(l []uint64, id uint64) bool {
+	for _, i := range l {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+// sameIds returns true if both lists contain the same ids, ignoring the order.
+func sameIds(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, id := range a {
+		if !contains(b, id) {
+			return false
+		}
+	}
+	return true
+}
+
+// sameUuids returns true if both lists contain the same uuids, ignoring the order.
+func sameUuids(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	m := make(map[string]bool)
+	for _, u := range b {
+		m[u] = true
+	}
+	for _, u := range a {
+		if !m[u] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/manishrjain/asanawarrior/x"
+)
+
+// testDepends has 1 -> 2 -> 3 in Asana, with 4 standing alone. Tasks 1 to 4 are in Taskwarrior as
+// u1 to u4.
+func testDepends() *depends {
+	atasks := []x.WarriorTask{
+		{Xid: 1, Depends: []uint64{2}},
+		{Xid: 2, Depends: []uint64{3}},
+		{Xid: 3},
+		{Xid: 4},
+	}
+	twtasks := []x.WarriorTask{
+		{Xid: 1, Uuid: "u1"}, {Xid: 2, Uuid: "u2"}, {Xid: 3, Uuid: "u3"}, {Xid: 4, Uuid: "u4"},
+		{Uuid: "u5"},
+	}
+	return newDepends(atasks, twtasks)
+}
+
+func TestAcyclic(t *testing.T) {
+	tests := []struct {
+		name string
+		xid  uint64
+		deps []uint64
+		want []uint64
+	}{
+		{"no deps", 3, nil, nil},
+		{"independent", 3, []uint64{4}, []uint64{4}},
+		{"direct cycle", 3, []uint64{2}, nil},
+		{"indirect cycle", 3, []uint64{1, 4}, []uint64{4}},
+		{"self", 4, []uint64{4}, nil},
+		{"along the chain", 1, []uint64{3}, []uint64{3}},
+		{"unknown task", 3, []uint64{9}, []uint64{9}},
+		{"new task", 0, []uint64{1, 3}, []uint64{1, 3}},
+	}
+	d := testDepends()
+	for _, tt := range tests {
+		if got := d.acyclic(tt.xid, tt.deps); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: acyclic(%d, %v) = %v, want %v", tt.name, tt.xid, tt.deps, got, tt.want)
+		}
+	}
+}
+
+func TestMerged(t *testing.T) {
+	tests := []struct {
+		name  string
+		asana x.WarriorTask
+		tw    x.WarriorTask
+		want  []uint64
+	}{
+		{"asana only", x.WarriorTask{Xid: 4, Depends: []uint64{3}}, x.WarriorTask{}, []uint64{3}},
+		{"taskwarrior only", x.WarriorTask{Xid: 4}, x.WarriorTask{DependsUuid: []string{"u3"}},
+			[]uint64{3}},
+		{"union", x.WarriorTask{Xid: 4, Depends: []uint64{2}},
+			x.WarriorTask{DependsUuid: []string{"u3", "u2"}}, []uint64{2, 3}},
+		{"untranslated uuid", x.WarriorTask{Xid: 4}, x.WarriorTask{DependsUuid: []string{"u5"}},
+			nil},
+		{"cycle dropped", x.WarriorTask{Xid: 3, Depends: []uint64{4}},
+			x.WarriorTask{DependsUuid: []string{"u1"}}, []uint64{4}},
+	}
+	d := testDepends()
+	for _, tt := range tests {
+		got := d.merged(tt.asana, tt.tw)
+		if len(got) == 0 && len(tt.want) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: merged = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestForTaskwarrior(t *testing.T) {
+	tests := []struct {
+		name string
+		xids []uint64
+		tw   []string
+		want []string
+	}{
+		{"translated", []uint64{2, 3}, nil, []string{"u2", "u3"}},
+		{"not in taskwarrior", []uint64{9}, nil, nil},
+		{"replaces translatable", []uint64{3}, []string{"u2"}, []string{"u3"}},
+		{"keeps untranslatable", []uint64{3}, []string{"u2", "u5"}, []string{"u3", "u5"}},
+		{"keeps unknown", nil, []string{"u9"}, []string{"u9"}},
+	}
+	d := testDepends()
+	for _, tt := range tests {
+		got := d.forTaskwarrior(tt.xids, x.WarriorTask{Xid: 4, Uuid: "u4", DependsUuid: tt.tw})
+		if len(got) == 0 && len(tt.want) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: forTaskwarrior(%v) = %v, want %v", tt.name, tt.xids, got, tt.want)
+		}
+	}
+}
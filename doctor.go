@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/manishrjain/asanawarrior/asana"
+	"github.com/manishrjain/asanawarrior/taskwarrior"
+)
+
+// builtinAttrs are Taskwarrior attributes which don't need to be defined as UDAs.
+var builtinAttrs = map[string]bool{
+	"priority": true, "due": true, "scheduled": true, "wait": true, "until": true,
+}
+
+// check prints the result of a single doctor check, and returns true if it passed.
+func check(name string, err error, detail string) bool {
+	if err != nil {
+		fmt.Printf("[FAIL] %-28s %v\n", name, err)
+		return false
+	}
+	fmt.Printf("[ OK ] %-28s %s\n", name, detail)
+	return true
+}
+
+func checkUda(name string, required bool) bool {
+	typ, err := taskwarrior.UdaType(name)
+	if err == nil && len(typ) == 0 {
+		if !required {
+			fmt.Printf("[WARN] %-28s not defined. Run: task config uda.%s.type string\n",
+				"UDA "+name, name)
+			return true
+		}
+		err = fmt.Errorf("not defined. Run: task config uda.%s.type string", name)
+	}
+	return check("UDA "+name, err, typ)
+}
+
+func checkDb() (string, error) {
+	version, err := db.Version()
+	if err != nil {
+		return *dbpath, err
+	}
+	mps, err := db.Mappings()
+	return fmt.Sprintf("%v (%s): schema version %d, %d tasks linked", *dbpath, *storeKind,
+		version, len(mps)), err
+}
+
+// runDoctor validates the token, workspace, Taskwarrior setup and the db.
+func runDoctor(ctx context.Context, args []string) error {
+	ok := true
+	version, err := taskwarrior.Version()
+	ok = check("Taskwarrior", err, version) && ok
+	ok = checkUda("xid", true) && ok
+	ok = checkUda("followers", false) && ok
+	for _, attr := range asana.MappedAttrs() {
+		if !builtinAttrs[attr] {
+			ok = checkUda(attr, true) && ok
+		}
+	}
+
+	detail, err := checkDb()
+	ok = check("Database", err, detail) && ok
+	detail, err = checkLock()
+	ok = check("Instance lock", err, detail) && ok
+
+	email, err := asana.Whoami(ctx)
+	if ok = check("Asana token", err, email) && ok; err == nil {
+		names, err := asana.Workspaces(ctx)
+		if err == nil {
+			err = fmt.Errorf("workspace %q not found in %q", asana.Domain(), names)
+			for _, n := range names {
+				if n == asana.Domain() {
+					err = nil
+				}
+			}
+		}
+		ok = check("Asana workspace", err, asana.Domain()) && ok
+	}
+
+	if !ok {
+		return fmt.Errorf("Some checks failed")
+	}
+	fmt.Println("All good.")
+	return nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/manishrjain/asanawarrior/asana"
+	"github.com/manishrjain/asanawarrior/taskwarrior"
+	"github.com/manishrjain/asanawarrior/x"
+	"github.com/pkg/errors"
+)
+
+var socketPath = flag.String("socket", os.Getenv("HOME")+"/.task/asanawarrior.sock",
+	"Unix socket on which the daemon hears of changes from the Taskwarrior hooks. Empty disables it.")
+var debounce = flag.Int("debounce", 5,
+	"Seconds to wait for more changes from the Taskwarrior hooks, before syncing the changed tasks.")
+
+var uuidExp = regexp.MustCompile("^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$")
+
+// listenHooks listens on the socket at path, and sends the UUIDs of the tasks changed in
+// Taskwarrior to the channel returned. The listener must be closed once done.
+func listenHooks(path string) (net.Listener, <-chan string, error) {
+	// A socket left behind by a daemon which crashed. We hold the lock, so it isn't in use.
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, nil, err
+	}
+
+	changed := make(chan string, 100)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				// Closed.
+				return
+			}
+			go readChanges(conn, changed)
+		}
+	}()
+	return l, changed, nil
+}
+
+// readChanges reads one UUID per line from the hook.
+func readChanges(conn net.Conn, changed chan<- string) {
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		uuid := strings.TrimSpace(scanner.Text())
+		if !uuidExp.MatchString(uuid) {
+			log.Printf("Ignoring invalid UUID from hook: %q", uuid)
+			continue
+		}
+		changed <- uuid
+	}
+}
+
+// fetchChanged returns the matches for the Taskwarrior tasks with the UUIDs given, fetching their
+// Asana tasks one by one. Tasks which need more than a plain sync are left for the next full sync:
+// those with actions left behind by an earlier sync, a broken link, or an Asana task which can't
+// be fetched or isn't synced.
+func fetchChanged(ctx context.Context, uuids []string) ([]*Match, error) {
+	ins, err := db.Intents()
+	if err != nil {
+		return nil, errors.Wrap(err, "Intents")
+	}
+	pending := make(map[string]bool)
+	for _, in := range ins {
+		pending[in.Key] = true
+	}
+	links, err := loadLinks()
+	if err != nil {
+		return nil, errors.Wrap(err, "loadLinks")
+	}
+
+	var matches []*Match
+	for _, uuid := range uuids {
+		tw, err := taskwarrior.GetTask(uuid)
+		if x.KindOf(err) == x.NotFound {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "taskwarrior.GetTask")
+		}
+		xid, has := links[uuid]
+		switch {
+		case pending[uuid]:
+			fmt.Printf("Leaving [%q] for the next full sync, to finish its last action.\n", tw.Name)
+			continue
+		case has && xid != tw.Xid:
+			fmt.Printf("Leaving [%q] for the next full sync, to relink it.\n", tw.Name)
+			continue
+		case tw.Xid == 0:
+			matches = append(matches, &Match{TaskWr: tw})
+			continue
+		}
+
+		at, err := asana.GetOneTask(ctx, tw.Xid)
+		if err == nil && !asana.InScope(at.Project) {
+			err = fmt.Errorf("project %q isn't synced", at.Project)
+		}
+		if err != nil {
+			fmt.Printf("Leaving [%q] for the next full sync: %v\n", tw.Name, err)
+			continue
+		}
+		matches = append(matches, &Match{Xid: at.Xid, Asana: at, TaskWr: tw})
+	}
+	return matches, nil
+}
+
+// syncChanged syncs just the Taskwarrior tasks changed, as heard from the hooks.
+func syncChanged(ctx context.Context, uuids []string) *syncStats {
+	fmt.Println()
+	fmt.Printf("Syncing %d tasks changed in Taskwarrior at %v\n", len(uuids), time.Now())
+	stats := &syncStats{Id: startRun(), Start: time.Now(), Actions: make(map[string]int)}
+	defer func() {
+		stats.End = time.Now()
+		saveStats(stats)
+	}()
+
+	matches, err := fetchChanged(ctx, uuids)
+	if err != nil {
+		log.Printf("Unable to fetch changed tasks: %+v", err)
+		stats.Errors = append(stats.Errors, err.Error())
+		return stats
+	}
+	stats.Matches = len(matches)
+	applyMatches(ctx, matches, stats, true)
+	return stats
+}
+
+// notifyDaemon tells the daemon listening on the socket that the task with uuid changed.
+func notifyDaemon(uuid string) error {
+	conn, err := net.DialTimeout("unix", *socketPath, time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	_, err = fmt.Fprintln(conn, uuid)
+	return err
+}
+
+// daemonDown returns true if notifyDaemon failed, because the daemon isn't running.
+func daemonDown(err error) bool {
+	if op, ok := err.(*net.OpError); ok {
+		if se, ok := op.Err.(*os.SyscallError); ok {
+			return se.Err == syscall.ENOENT || se.Err == syscall.ECONNREFUSED
+		}
+	}
+	return false
+}
+
+// hookTask is the part of the task passed to the hooks, which we need.
+type hookTask struct {
+	Uuid string `json:"uuid"`
+}
+
+// runHook runs as the Taskwarrior on-add or on-modify hook. Taskwarrior passes the task added, or
+// the original and the modified task, as JSON lines on stdin. The hook must print the last one
+// back on stdout, and shouldn't print anything else. It mustn't fail the add or modify either, so
+// any other problem is only logged. The daemon not running isn't a problem.
+func runHook(ctx context.Context, args []string) error {
+	var last string
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); len(line) > 0 {
+			last = line
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("hook: Unable to read the task: %v", err)
+		return nil
+	}
+	if len(last) == 0 {
+		// Nothing to pass back.
+		return nil
+	}
+	if _, err := fmt.Println(last); err != nil {
+		return err
+	}
+
+	var t hookTask
+	if err := json.Unmarshal([]byte(last), &t); err != nil || len(t.Uuid) == 0 ||
+		len(*socketPath) == 0 {
+		return nil
+	}
+	if err := notifyDaemon(t.Uuid); err != nil && !daemonDown(err) {
+		log.Printf("hook: Unable to notify the daemon: %v", err)
+	}
+	return nil
+}
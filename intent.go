@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/manishrjain/asanawarrior/asana"
+	"github.com/manishrjain/asanawarrior/x"
+	"github.com/pkg/errors"
+)
+
+// intent records a sync action before it modifies Asana or Taskwarrior, and is removed once the
+// action completes. Intents left behind by a crash, or by a request which failed without us
+// knowing whether it went through, are resolved by the next sync before it plans any actions.
+type intent struct {
+	Key     string    `json:"key"`
+	Action  string    `json:"action"`
+	Xid     uint64    `json:"xid"` // For create-asana, set once Asana assigns it.
+	Uuid    string    `json:"uuid"`
+	Name    string    `json:"name"`
+	Project string    `json:"project"`
+	Run     uint64    `json:"run"`
+	Time    time.Time `json:"time"`
+}
+
+// intentKey identifies the task being synced. Only one action runs per task at a time.
+func intentKey(m *Match) string {
+	if len(m.TaskWr.Uuid) > 0 {
+		return m.TaskWr.Uuid
+	}
+	return strconv.FormatUint(m.Xid, 10)
+}
+
+// recordIntent stores the intent to apply act to the match. xid is the Asana task it applies to.
+func recordIntent(m *Match, act action, xid uint64) error {
+	in := &intent{Key: intentKey(m), Action: act.String(), Xid: xid, Uuid: m.TaskWr.Uuid,
+		Name: m.TaskWr.Name, Project: m.TaskWr.Project, Run: currentRun, Time: time.Now()}
+	if m.Xid > 0 {
+		in.Name, in.Project = m.Asana.Name, m.Asana.Project
+	}
+	return db.PutIntent(in)
+}
+
+// applyWithIntent applies act to the match like applyMatch, keeping an intent in the db until
+// it's done.
+func applyWithIntent(ctx context.Context, m *Match, act action, e *entry) error {
+	if err := recordIntent(m, act, m.Xid); err != nil {
+		return errors.Wrap(err, "recordIntent")
+	}
+	if err := applyMatch(ctx, m, act, e); err != nil {
+		// Keep the intent. The next sync figures out how far the action got.
+		return err
+	}
+	if err := db.DeleteIntent(intentKey(m)); err != nil {
+		log.Printf("Unable to delete intent of [%q]: %v", e.Name, err)
+	}
+	return nil
+}
+
+// createdTasks finds the Asana tasks which could have been created for the intent, whose id we
+// never got. They must have the same name and project, have been created after the intent, and
+// not be linked to any Taskwarrior task.
+func createdTasks(in *intent, atasks []x.WarriorTask, linked map[uint64]bool) []uint64 {
+	var found []uint64
+	for _, at := range atasks {
+		if at.Name == in.Name && at.Project == in.Project && !linked[at.Xid] &&
+			at.Created.After(in.Time.Add(-relinkWindow)) {
+			found = append(found, at.Xid)
+		}
+	}
+	return found
+}
+
+// resolveIntent rolls the action recorded in the intent forward, and returns true once it's
+// resolved. Asana or Taskwarrior may have been modified partially. So, the modification time of
+// the side being written to is set to its current value, which makes the next plan push the other
+// side again. A create in Asana whose task can't be found didn't go through, and is left for the
+// next plan to retry. One whose task can't be told apart, or linked, stays unresolved until the
+// user links it. Creating it again would duplicate it.
+func resolveIntent(in *intent, amap map[uint64]x.WarriorTask, twmap map[string]x.WarriorTask,
+	atasks []x.WarriorTask, linked map[uint64]bool) (bool, error) {
+
+	at, inAsana := amap[in.Xid]
+	tw, inTaskw := twmap[in.Uuid]
+	switch in.Action {
+	case actCreateAsana.String():
+		xid := in.Xid
+		if xid == 0 {
+			xid = tw.Xid
+		}
+		if !inTaskw {
+			// Nothing left to create, or link.
+			return true, nil
+		}
+		if xid == 0 {
+			found := createdTasks(in, atasks, linked)
+			if len(found) > 1 {
+				fmt.Printf("Found %d Asana tasks which could have been created for [%q]: %v."+
+					" Please check them, and link one with: asanawarrior relink -uuid %s -xid"+
+					" <id>\n", len(found), in.Name, found, in.Uuid)
+				return false, nil
+			}
+			if len(found) == 0 {
+				fmt.Printf("Create in Asana of [%q] didn't go through. Retrying.\n", in.Name)
+				return true, nil
+			}
+			xid = found[0]
+		}
+		if at, inAsana = amap[xid]; !inAsana {
+			fmt.Printf("Unable to link Asana task %d created for [%q]. Please check it, and link"+
+				" it with: asanawarrior relink -uuid %s -xid %d\n", xid, in.Name, in.Uuid, xid)
+			return false, nil
+		}
+		// Link the tasks, and push the Taskwarrior task again to finish the create.
+		fmt.Printf("Found Asana task %d created for [%q]. Linking.\n", xid, in.Name)
+		linked[xid] = true
+		return true, db.PutMapping(&mapping{Xid: xid, Uuid: tw.Uuid, Workspace: asana.Domain(),
+			AsanaTs: at.Modified, Synced: time.Now(), Last: snapshot{Asana: &at, Taskw: &tw}})
+
+	case actCreateTaskw.String():
+		// The task is created in Taskwarrior along with its xid, which links it.
+		return true, nil
+	}
+
+	mp, err := db.GetMapping(in.Xid)
+	if err != nil || mp == nil || mp.Uuid != in.Uuid {
+		return err == nil, err
+	}
+	switch in.Action {
+	case actOverwriteAsana.String():
+		if !inAsana || !inTaskw {
+			return true, nil
+		}
+		if !asana.Updated(tw, at) {
+			// The write didn't go through, or Asana was modified since. Leave the timestamps, so
+			// the next plan pushes Taskwarrior again, or sees the conflict.
+			fmt.Printf("Asana task of [%q] doesn't match Taskwarrior after an unfinished"+
+				" overwrite. Syncing it again.\n", in.Name)
+			return true, nil
+		}
+		mp.AsanaTs = at.Modified
+	case actDeleteAsana.String():
+		if !inAsana {
+			return true, nil
+		}
+		mp.AsanaTs = at.Modified
+	case actOverwriteTaskw.String(), actDeleteTaskw.String():
+		if !inTaskw {
+			return true, nil
+		}
+		mp.TaskwTs = tw.Modified
+	case actSyncDepends.String():
+		// Dependencies are compared directly. No need to push either side.
+		if inAsana {
+			mp.AsanaTs = at.Modified
+		}
+		if inTaskw {
+			mp.TaskwTs = tw.Modified
+		}
+	default:
+		return true, nil
+	}
+	fmt.Printf("Resuming %s of [%q].\n", in.Action, in.Name)
+	return true, db.PutMapping(mp)
+}
+
+// unfinishedCreates returns the UUIDs of the Taskwarrior tasks with a create in Asana left
+// unresolved. They aren't created again, until it's resolved.
+func unfinishedCreates() (map[string]bool, error) {
+	ins, err := db.Intents()
+	if err != nil {
+		return nil, err
+	}
+	uuids := make(map[string]bool)
+	for _, in := range ins {
+		if in.Action == actCreateAsana.String() {
+			uuids[in.Uuid] = true
+		}
+	}
+	return uuids, nil
+}
+
+// recoverIntents resolves the intents left behind by earlier syncs, before matching the tasks.
+func recoverIntents(atasks, twtasks []x.WarriorTask) error {
+	ins, err := db.Intents()
+	if err != nil || len(ins) == 0 {
+		return err
+	}
+	mps, err := db.Mappings()
+	if err != nil {
+		return err
+	}
+	linked := make(map[uint64]bool)
+	for _, mp := range mps {
+		linked[mp.Xid] = true
+	}
+	amap := make(map[uint64]x.WarriorTask)
+	for _, at := range atasks {
+		amap[at.Xid] = at
+	}
+	twmap := make(map[string]x.WarriorTask)
+	for _, tw := range twtasks {
+		twmap[tw.Uuid] = tw
+		if tw.Xid > 0 {
+			linked[tw.Xid] = true
+		}
+	}
+
+	for _, in := range ins {
+		if !fetchErr.Complete(in.Project) {
+			// Wait till we can see all the tasks in the project.
+			continue
+		}
+		resolved, err := resolveIntent(in, amap, twmap, atasks, linked)
+		if err != nil {
+			return errors.Wrapf(err, "resolveIntent %s of [%q]", in.Action, in.Name)
+		}
+		if !resolved {
+			continue
+		}
+		if err := db.DeleteIntent(in.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
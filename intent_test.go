@@ -0,0 +1,202 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/manishrjain/asanawarrior/x"
+)
+
+// useTestDb opens a fresh bolt db as db. The returned func closes and removes it.
+func useTestDb(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "asanawarrior")
+	if err != nil {
+		t.Fatal(err)
+	}
+	*storeKind = "bolt"
+	if db, err = openStore(filepath.Join(dir, "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestResolveIntent(t *testing.T) {
+	start := time.Date(2017, 3, 1, 10, 0, 0, 0, time.UTC)
+	old, now := start.Add(-time.Hour), start.Add(time.Minute)
+	task := func(xid uint64, uuid, name string) x.WarriorTask {
+		return x.WarriorTask{Xid: xid, Uuid: uuid, Name: name, Project: "Work", Created: now,
+			Modified: now}
+	}
+	create := func(xid uint64) *intent {
+		return &intent{Key: "u1", Action: actCreateAsana.String(), Xid: xid, Uuid: "u1",
+			Name: "a", Project: "Work", Time: start}
+	}
+	overwrite := func(act action) *intent {
+		return &intent{Key: "u1", Action: act.String(), Xid: 1, Uuid: "u1", Name: "a",
+			Project: "Work", Time: start}
+	}
+	linkedU1 := &mapping{Xid: 1, Uuid: "u1", AsanaTs: old, TaskwTs: old}
+
+	tests := []struct {
+		name    string
+		in      *intent
+		mp      *mapping // Mapping before resolving.
+		atasks  []x.WarriorTask
+		twtasks []x.WarriorTask
+		want    *mapping // Mapping of xid 1 after, or nil if none.
+		kept    bool     // Intent left unresolved.
+	}{
+		{
+			name:    "create with xid",
+			in:      create(1),
+			atasks:  []x.WarriorTask{task(1, "", "a")},
+			twtasks: []x.WarriorTask{task(0, "u1", "a")},
+			want:    &mapping{Xid: 1, Uuid: "u1", AsanaTs: now},
+		},
+		{
+			name:    "create found by name",
+			in:      create(0),
+			atasks:  []x.WarriorTask{task(1, "", "a"), task(2, "", "b")},
+			twtasks: []x.WarriorTask{task(0, "u1", "a")},
+			want:    &mapping{Xid: 1, Uuid: "u1", AsanaTs: now},
+		},
+		{
+			name:    "create ambiguous",
+			in:      create(0),
+			atasks:  []x.WarriorTask{task(1, "", "a"), task(2, "", "a")},
+			twtasks: []x.WarriorTask{task(0, "u1", "a")},
+			kept:    true,
+		},
+		{
+			name:    "create not fetched",
+			in:      create(5),
+			atasks:  []x.WarriorTask{task(1, "", "a")},
+			twtasks: []x.WarriorTask{task(0, "u1", "a")},
+			kept:    true,
+		},
+		{
+			name:    "create didn't go through",
+			in:      create(0),
+			atasks:  []x.WarriorTask{task(1, "", "b")},
+			twtasks: []x.WarriorTask{task(0, "u1", "a")},
+		},
+		{
+			name:   "create of deleted task",
+			in:     create(1),
+			atasks: []x.WarriorTask{task(1, "", "a")},
+		},
+		{
+			name:    "overwrite asana",
+			in:      overwrite(actOverwriteAsana),
+			mp:      linkedU1,
+			atasks:  []x.WarriorTask{task(1, "", "a")},
+			twtasks: []x.WarriorTask{task(1, "u1", "a")},
+			want:    &mapping{Xid: 1, Uuid: "u1", AsanaTs: now, TaskwTs: old},
+		},
+		{
+			name:    "overwrite asana didn't go through",
+			in:      overwrite(actOverwriteAsana),
+			mp:      linkedU1,
+			atasks:  []x.WarriorTask{task(1, "", "b")},
+			twtasks: []x.WarriorTask{task(1, "u1", "a")},
+			want:    &mapping{Xid: 1, Uuid: "u1", AsanaTs: old, TaskwTs: old},
+		},
+		{
+			name:   "overwrite asana partly",
+			in:     overwrite(actOverwriteAsana),
+			mp:     linkedU1,
+			atasks: []x.WarriorTask{task(1, "", "a")},
+			twtasks: []x.WarriorTask{{Xid: 1, Uuid: "u1", Name: "a", Project: "Work",
+				Tags: []string{"later"}, Modified: now}},
+			want: &mapping{Xid: 1, Uuid: "u1", AsanaTs: old, TaskwTs: old},
+		},
+		{
+			name:    "overwrite taskwarrior",
+			in:      overwrite(actOverwriteTaskw),
+			mp:      linkedU1,
+			atasks:  []x.WarriorTask{task(1, "", "a")},
+			twtasks: []x.WarriorTask{task(1, "u1", "a")},
+			want:    &mapping{Xid: 1, Uuid: "u1", AsanaTs: old, TaskwTs: now},
+		},
+		{
+			name:    "sync depends",
+			in:      overwrite(actSyncDepends),
+			mp:      linkedU1,
+			atasks:  []x.WarriorTask{task(1, "", "a")},
+			twtasks: []x.WarriorTask{task(1, "u1", "a")},
+			want:    &mapping{Xid: 1, Uuid: "u1", AsanaTs: now, TaskwTs: now},
+		},
+		{
+			name:    "overwrite relinked task",
+			in:      overwrite(actOverwriteAsana),
+			mp:      &mapping{Xid: 1, Uuid: "u2", AsanaTs: old, TaskwTs: old},
+			atasks:  []x.WarriorTask{task(1, "", "a")},
+			twtasks: []x.WarriorTask{task(1, "u2", "a")},
+			want:    &mapping{Xid: 1, Uuid: "u2", AsanaTs: old, TaskwTs: old},
+		},
+		{
+			name:   "overwrite unlinked task",
+			in:     overwrite(actOverwriteAsana),
+			atasks: []x.WarriorTask{task(1, "", "a")},
+		},
+	}
+	for _, tt := range tests {
+		done := useTestDb(t)
+		if tt.mp != nil {
+			if err := db.PutMapping(tt.mp); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.PutIntent(tt.in); err != nil {
+			t.Fatal(err)
+		}
+		if err := recoverIntents(tt.atasks, tt.twtasks); err != nil {
+			t.Errorf("%s: recoverIntents: %v", tt.name, err)
+		}
+		ins, err := db.Intents()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kept := len(ins) > 0; kept != tt.kept {
+			t.Errorf("%s: intent kept = %v, want %v", tt.name, kept, tt.kept)
+		}
+		if unfinished, err = unfinishedCreates(); err != nil {
+			t.Fatal(err)
+		}
+		for _, tw := range tt.twtasks {
+			if tw.Xid > 0 || tt.want != nil {
+				continue
+			}
+			want := actCreateAsana
+			if tt.kept {
+				want = actNone
+			}
+			if act, err := planMatch(&Match{TaskWr: tw}); err != nil || act != want {
+				t.Errorf("%s: planMatch = %v, %v, want %v", tt.name, act, err, want)
+			}
+		}
+
+		mp, err := db.GetMapping(1)
+		switch {
+		case err != nil:
+			t.Errorf("%s: GetMapping: %v", tt.name, err)
+		case mp == nil && tt.want == nil:
+		case mp == nil || tt.want == nil:
+			t.Errorf("%s: mapping = %+v, want %+v", tt.name, mp, tt.want)
+		case mp.Uuid != tt.want.Uuid || !mp.AsanaTs.Equal(tt.want.AsanaTs) ||
+			!mp.TaskwTs.Equal(tt.want.TaskwTs):
+			t.Errorf("%s: mapping = %v %v %v, want %v %v %v", tt.name, mp.Uuid, mp.AsanaTs,
+				mp.TaskwTs, tt.want.Uuid, tt.want.AsanaTs, tt.want.TaskwTs)
+		}
+		done()
+	}
+}
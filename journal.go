@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/manishrjain/asanawarrior/x"
+	"github.com/pkg/errors"
+)
+
+// The journal records every sync run, and every action applied during a run, along with the
+// state of the task before and after the action.
+
+var keepDays = flag.Int("keep-days", 90,
+	"Days of sync runs and their journal entries to keep. Zero keeps them all.")
+var keepRuns = flag.Int("keep-runs", 1000,
+	"Number of the latest sync runs to keep, along with their journal entries. Zero keeps them all.")
+
+// syncStats summarizes a sync run.
+type syncStats struct {
+	Id      uint64         `json:"id"`
+	Start   time.Time      `json:"start"`
+	End     time.Time      `json:"end"`
+	Matches int            `json:"matches"`
+	Actions map[string]int `json:"actions"`
+	Errors  []string       `json:"errors,omitempty"`
+	// Deletions held in quarantine at the end of the run.
+	Quarantined int    `json:"quarantined,omitempty"`
+	Undo        uint64 `json:"undo,omitempty"` // Run undone by this run.
+}
+
+// snapshot is the state of a task in Asana and Taskwarrior. Either can be missing.
+type snapshot struct {
+	Asana *x.WarriorTask `json:"asana,omitempty"`
+	Taskw *x.WarriorTask `json:"taskw,omitempty"`
+}
+
+// entry records a single action applied to a task.
+type entry struct {
+	Run    uint64    `json:"run"`
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	Name   string    `json:"name"`
+	Xid    uint64    `json:"xid,omitempty"`
+	Uuid   string    `json:"uuid,omitempty"`
+	Before snapshot  `json:"before"`
+	After  snapshot  `json:"after"`
+	Error  string    `json:"error,omitempty"`
+}
+
+func present(wt x.WarriorTask) *x.WarriorTask {
+	if len(wt.Uuid) == 0 && wt.Xid == 0 {
+		return nil
+	}
+	return &wt
+}
+
+func newEntry(m *Match, act action) *entry {
+	e := &entry{
+		Run:    currentRun,
+		Time:   time.Now(),
+		Action: act.String(),
+		Name:   m.Asana.Name,
+		Xid:    m.Xid,
+		Uuid:   m.TaskWr.Uuid,
+	}
+	if len(e.Name) == 0 {
+		e.Name = m.TaskWr.Name
+	}
+	if m.Xid > 0 {
+		e.Before.Asana = present(m.Asana)
+	}
+	e.Before.Taskw = present(m.TaskWr)
+	return e
+}
+
+// currentRun is the id of the sync run in progress.
+var currentRun uint64
+
+// startRun allocates an id for a new sync run.
+func startRun() uint64 {
+	id, err := db.NextRun()
+	if err != nil {
+		log.Printf("Unable to start a run in journal: %v", err)
+	}
+	currentRun = id
+	return id
+}
+
+func saveStats(s *syncStats) {
+	if err := db.SaveRun(s); err != nil {
+		log.Printf("Unable to store sync stats: %v", err)
+	}
+}
+
+// journalAction stores the entry in the journal.
+func journalAction(e *entry) {
+	if err := db.AddEntry(e); err != nil {
+		log.Printf("Unable to store journal entry: %v", err)
+	}
+}
+
+// lastRun returns the stats of the most recent sync run which finished, if any.
+func lastRun() (*syncStats, error) {
+	var last *syncStats
+	err := db.RecentRuns(func(r *syncStats) bool {
+		if r.End.IsZero() {
+			return true
+		}
+		last = r
+		return false
+	})
+	return last, err
+}
+
+// pruneJournal forgets the sync runs beyond the last -keep-runs, or started over -keep-days ago,
+// along with their journal entries.
+func pruneJournal() error {
+	cutoff := time.Now().AddDate(0, 0, -*keepDays)
+	var n int
+	var newest uint64 // Of the runs to forget.
+	err := db.RecentRuns(func(r *syncStats) bool {
+		n++
+		if (*keepRuns > 0 && n > *keepRuns) || (*keepDays > 0 && r.Start.Before(cutoff)) {
+			newest = r.Id
+			return false
+		}
+		return true
+	})
+	if err != nil || newest == 0 {
+		return err
+	}
+	return db.Prune(newest + 1)
+}
+
+// parseTime accepts either a date, a timestamp, or a duration relative to now (e.g. 24h).
+func parseTime(s string) (time.Time, error) {
+	if len(s) == 0 {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// changes returns the fields which differ between before and after.
+func changes(before, after *x.WarriorTask) []string {
+	if before == nil || after == nil {
+		return nil
+	}
+	var result []string
+	bv, av := reflect.ValueOf(*before), reflect.ValueOf(*after)
+	for i := 0; i < bv.NumField(); i++ {
+		name := bv.Type().Field(i).Name
+		if name == "Modified" {
+			continue
+		}
+		b, a := bv.Field(i).Interface(), av.Field(i).Interface()
+		if !reflect.DeepEqual(b, a) {
+			result = append(result, fmt.Sprintf("%s: %v -> %v", name, b, a))
+		}
+	}
+	return result
+}
+
+func printEntry(e *entry) {
+	fmt.Printf("%s run:%-4d %-21s [%q] xid:%d uuid:%s\n", e.Time.Format("2006-01-02 15:04:05"),
+		e.Run, e.Action, e.Name, e.Xid, e.Uuid)
+	if len(e.Error) > 0 {
+		fmt.Printf("\tERROR: %s\n", e.Error)
+	}
+	for _, c := range changes(e.Before.Asana, e.After.Asana) {
+		fmt.Printf("\tAsana       %s\n", c)
+	}
+	for _, c := range changes(e.Before.Taskw, e.After.Taskw) {
+		fmt.Printf("\tTaskwarrior %s\n", c)
+	}
+}
+
+func printRun(r syncStats) {
+	var acts []string
+	for name, n := range r.Actions {
+		acts = append(acts, fmt.Sprintf("%s:%d", name, n))
+	}
+	sort.Strings(acts)
+	fmt.Printf("run:%-4d %s took:%-12v tasks:%-5d errors:%-3d %s\n", r.Id,
+		r.Start.Format("2006-01-02 15:04:05"), r.End.Sub(r.Start).Round(time.Millisecond),
+		r.Matches, len(r.Errors), strings.Join(acts, " "))
+}
+
+// runHistory lists the sync runs, or the actions applied, filtered by task, time range, run or
+// action type.
+func runHistory(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	taskf := fs.String("task", "", "Asana id, Taskwarrior UUID (or prefix), or part of task name.")
+	since := fs.String("since", "", "Only show actions after this date, timestamp, or duration ago.")
+	until := fs.String("until", "", "Only show actions before this date, timestamp, or duration ago.")
+	act := fs.String("action", "", "Only show actions of this type, for e.g. overwrite-asana.")
+	run := fs.Uint64("run", 0, "Only show actions applied during this run.")
+	fs.Parse(args)
+
+	from, err := parseTime(*since)
+	if err != nil {
+		return errors.Wrap(err, "since")
+	}
+	to, err := parseTime(*until)
+	if err != nil {
+		return errors.Wrap(err, "until")
+	}
+
+	if len(*taskf) == 0 && len(*act) == 0 && *run == 0 && from.IsZero() && to.IsZero() {
+		runs, err := db.Runs()
+		if err != nil {
+			return err
+		}
+		for _, r := range runs {
+			printRun(r)
+		}
+		return nil
+	}
+
+	xid, _ := strconv.ParseUint(*taskf, 10, 64)
+	entries, err := db.Entries(func(e *entry) bool {
+		switch {
+		case *run > 0 && e.Run != *run:
+			return false
+		case len(*act) > 0 && e.Action != *act:
+			return false
+		case !from.IsZero() && e.Time.Before(from):
+			return false
+		case !to.IsZero() && e.Time.After(to):
+			return false
+		case len(*taskf) > 0:
+			return (xid > 0 && e.Xid == xid) || (len(e.Uuid) > 0 && strings.HasPrefix(e.Uuid, *taskf)) ||
+				strings.Contains(strings.ToLower(e.Name), strings.ToLower(*taskf))
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		printEntry(e)
+	}
+	fmt.Printf("\n%d actions found.\n", len(entries))
+	return nil
+}
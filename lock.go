@@ -0,0 +1,122 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var lockPath = flag.String("lock", os.Getenv("HOME")+"/.task/asanawarrior.lock",
+	"File locked by the running instance, so only one syncs with Taskwarrior at a time.")
+var lockTimeout = flag.Int("lock-timeout", 10,
+	"Seconds to wait for another instance to release the lock and the db.")
+
+// instanceLock is an exclusive flock on the lock file, which holds the PID of its owner. The kernel
+// releases the flock when the process exits, however it exits. So, a lock file with a PID but no
+// flock was left behind by an instance which crashed, and is taken over.
+type instanceLock struct {
+	f *os.File
+}
+
+// lockHolder returns the PID written to the lock file, or zero if there's none.
+func lockHolder(path string) int {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
+
+// heldBy describes the holder of the lock file, for errors.
+func heldBy(path string) string {
+	if pid := lockHolder(path); pid > 0 {
+		return fmt.Sprintf(" with PID %d", pid)
+	}
+	return ""
+}
+
+// acquireLock locks the file at path, waiting up to timeout for another instance to release it.
+func acquireLock(path string, timeout time.Duration) (*instanceLock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to open lock file")
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK {
+			f.Close()
+			return nil, errors.Wrapf(err, "Unable to lock %v", path)
+		}
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, fmt.Errorf("Another asanawarrior is running%s. Timed out after %v"+
+				" waiting for it to release %v", heldBy(path), timeout, path)
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+
+	if pid := lockHolder(path); pid > 0 {
+		fmt.Printf("Taking over stale lock of PID %d, which didn't exit cleanly.\n", pid)
+	}
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "Unable to write PID to lock file")
+	}
+	return &instanceLock{f: f}, nil
+}
+
+// instance is the lock held by this process, if any.
+var instance *instanceLock
+
+// lockInstance takes the instance lock, for commands which only modify anything in some of their
+// modes. So, they can still be run in the other modes, while the daemon is running.
+func lockInstance() error {
+	if instance != nil {
+		return nil
+	}
+	l, err := acquireLock(*lockPath, time.Duration(*lockTimeout)*time.Second)
+	if err != nil {
+		return err
+	}
+	instance = l
+	return nil
+}
+
+// release clears the PID and unlocks the file. The file itself is left in place, because another
+// instance may already be waiting on it.
+func (l *instanceLock) release() {
+	l.f.Truncate(0)
+	syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN)
+	l.f.Close()
+}
+
+// checkLock reports whether an instance holds the lock right now.
+func checkLock() (string, error) {
+	pid := lockHolder(*lockPath)
+	if pid == 0 {
+		return fmt.Sprintf("%v: not held", *lockPath), nil
+	}
+	if err := syscall.Kill(pid, 0); err == syscall.ESRCH {
+		return fmt.Sprintf("%v: stale, PID %d isn't running", *lockPath, pid), nil
+	}
+	return fmt.Sprintf("%v: held by PID %d", *lockPath, pid), nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
@@ -8,7 +9,6 @@ import (
 	"time"
 
 	"github.com/0xAX/notificator"
-	"github.com/boltdb/bolt"
 	"github.com/manishrjain/asanawarrior/asana"
 	"github.com/manishrjain/asanawarrior/taskwarrior"
 	"github.com/manishrjain/asanawarrior/x"
@@ -21,17 +21,31 @@ var dbpath = flag.String("db", os.Getenv("HOME")+"/.task/asanawarrior.db",
 var notifyInterval = flag.Int("interval", 10,
 	"Minimum duration in seconds between successive notifications. Set to zero for no notifications.")
 var maxDeletes = flag.Int("deletes", 5,
-	"If Asanawarrior sees more than these number of deletes, it's going to crash to"+
-		" protect your Asana from mass deletion.")
+	"If Asanawarrior sees more than these number of deletes in Asana or Taskwarrior, it"+
+		" quarantines them until approved, to protect against mass deletion.")
+var workers = flag.Int("workers", 4,
+	"Number of tasks to sync concurrently. Operations on the same task are never run in parallel.")
 
-var db *bolt.DB
-var bucketName = []byte("aw")
+var db store
 var notify *notificator.Notificator
+var deps = newDepends(nil, nil)
+
+// fetchErr lists the Asana projects whose tasks couldn't be fetched in this sync.
+var fetchErr *asana.FetchError
+
+// unfinished has the UUIDs of the Taskwarrior tasks, whose create in Asana may have gone through
+// but couldn't be linked.
+var unfinished map[string]bool
+
+// lastFetch is when all the tasks were last fetched. Until then, the Asana cache and deps are
+// empty, and tasks changed in Taskwarrior can't be synced on their own.
+var lastFetch time.Time
 
 type Match struct {
 	Xid    uint64
 	Asana  x.WarriorTask
 	TaskWr x.WarriorTask
+	Relink bool // Taskwarrior lost the xid, which is known from the db.
 }
 
 type notification struct {
@@ -82,78 +96,188 @@ func approxAfter(t1, t2 time.Time) bool {
 	return t1.Sub(t2) > time.Second
 }
 
-func asanaKey(xid uint64) []byte {
-	return []byte(fmt.Sprintf("asana-%d", xid))
-}
-
-func taskwKey(uuid string) []byte {
-	return []byte(fmt.Sprintf("taskw-%s", uuid))
+// forTaskwarrior returns the Asana task, with the information Taskwarrior needs to
+// overwrite its copy of the task.
+func forTaskwarrior(m *Match) x.WarriorTask {
+	at := m.Asana
+	at.DependsUuid = deps.forTaskwarrior(at.Depends, m.TaskWr)
+	if !at.Started.IsZero() && !m.TaskWr.Started.IsZero() {
+		// Asana doesn't know when the task was started. So, retain the start time.
+		at.Started = m.TaskWr.Started
+	}
+	return at
 }
 
-func storeInDb(asanaTask, twTask x.WarriorTask) {
-	if err := db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucketName)
-		if err := b.Put(asanaKey(asanaTask.Xid),
-			[]byte(asanaTask.Modified.Format(time.RFC3339))); err != nil {
-			return err
-		}
-		if err := b.Put(taskwKey(twTask.Uuid),
-			[]byte(twTask.Modified.Format(time.RFC3339))); err != nil {
-			return err
-		}
-		return nil
+// action is what needs to be done to bring a match in sync.
+type action int
+
+const (
+	actNone action = iota
+	actCreateAsana
+	actCreateTaskw
+	actDeleteTaskw
+	actOverwriteTaskw
+	actDeleteAsana
+	actOverwriteAsana
+	actSyncDepends
+	actRelinkTaskw
+)
 
-	}); err != nil {
-		log.Fatalf("Write to db failed with error: %v", err)
-	}
+var actionNames = []string{
+	"none", "create-asana", "create-taskwarrior", "delete-taskwarrior", "overwrite-taskwarrior",
+	"delete-asana", "overwrite-asana", "sync-depends", "relink-taskwarrior",
 }
 
-func getSyncTimestamps(xid uint64, uuid string) (time.Time, time.Time) {
-	var at, tt time.Time
-	db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucketName)
-		ats := string(b.Get(asanaKey(xid)))
-		tts := string(b.Get(taskwKey(uuid)))
-		var err error
-		if at, err = time.Parse(time.RFC3339, ats); err != nil {
-			log.Fatalf("Unable to find asana ts: %v %v", xid, uuid)
-		}
-		if tt, err = time.Parse(time.RFC3339, tts); err != nil {
-			log.Fatalf("Unable to find taskwarrior ts: %v %v", xid, uuid)
-		}
-		return nil
-	})
-	return at, tt
+func (a action) String() string {
+	return actionNames[a]
 }
 
-func syncMatch(m *Match, deleteFromAsana *[]*Match) error {
+// planMatch figures out what needs to be done to sync the match, without doing it.
+func planMatch(m *Match) (action, error) {
 	if m.Xid == 0 {
 		// Task not present in Asana, but present in TW.
-
+		if !asana.InScope(m.TaskWr.Project) {
+			// Project isn't being synced.
+			return actNone, nil
+		}
 		if m.TaskWr.Xid > 0 {
 			if m.TaskWr.Deleted {
 				// Already deleted from TW. Do nothing.
-				return nil
+				return actNone, nil
+			}
+			if !fetchErr.Complete(m.TaskWr.Project) {
+				// We couldn't fetch the project's tasks. Absence doesn't mean it got deleted.
+				return actNone, nil
 			}
-
 			// This task used to have an Asana ID. But, we can't find the corresponding Asana task.
 			// It can happen when Asana task was deleted.
 			// If so, delete the task from TW as well.
-			fmt.Printf("Delete from Taskwarrior: [%q]\n", m.TaskWr.Name)
-			pushNotification("Delete", m.TaskWr.Name)
+			return actDeleteTaskw, nil
+		}
+		if unfinished[m.TaskWr.Uuid] {
+			// Creating it again could duplicate it in Asana.
+			return actNone, nil
+		}
+		return actCreateAsana, nil
+	}
 
-			if err := taskwarrior.Delete(m.TaskWr); err != nil {
-				return errors.Wrap(err, "Delete from Taskwarrior")
-			}
-			return nil
+	if m.TaskWr.Xid == 0 {
+		// No Asana xid found in Taskwarrior. So, create it.
+		return actCreateTaskw, nil
+	}
+
+	if m.Relink {
+		// Write the xid back to TW first. Any other changes get picked up by the next sync.
+		return actRelinkTaskw, nil
+	}
+
+	// Task is present in both Asana and TW.
+	asanaTs, taskwTs, found, err := getSyncTimestamps(m.Asana.Xid, m.TaskWr.Uuid)
+	if err != nil {
+		return actNone, err
+	}
+	if !found {
+		// No record of the last sync, for e.g. after a reset. Consider Asana as the source of truth.
+		return actOverwriteTaskw, nil
+	}
+	if approxAfter(m.Asana.Modified, asanaTs) {
+		// Asana was updated. Overwrite TW.
+		return actOverwriteTaskw, nil
+	}
+	if m.TaskWr.Deleted {
+		// If task has been marked as deleted since the last modification.
+		if approxAfter(m.TaskWr.Modified, taskwTs) {
+			return actDeleteAsana, nil
+		}
+		return actNone, nil
+	}
+	if approxAfter(m.TaskWr.Modified, taskwTs) {
+		// TW was updated. Overwrite Asana.
+		return actOverwriteAsana, nil
+	}
+	merged := deps.merged(m.Asana, m.TaskWr)
+	if !sameIds(merged, m.Asana.Depends) ||
+		!sameUuids(deps.forTaskwarrior(merged, m.TaskWr), m.TaskWr.DependsUuid) {
+		return actSyncDepends, nil
+	}
+	return actNone, nil
+}
+
+// conflict returns true if the task was modified in both Asana and Taskwarrior since the
+// last sync. In such a case, Asana wins.
+func conflict(m *Match) bool {
+	if m.Xid == 0 || m.TaskWr.Xid == 0 {
+		return false
+	}
+	asanaTs, taskwTs, found, err := getSyncTimestamps(m.Asana.Xid, m.TaskWr.Uuid)
+	return err == nil && found && approxAfter(m.Asana.Modified, asanaTs) &&
+		approxAfter(m.TaskWr.Modified, taskwTs)
+}
+
+// syncMatch brings the match in sync, and returns the action it took. Deletions are appended to
+// deletes instead, if it's not nil. Every action taken is journaled, and recorded as an intent
+// while it's being applied.
+func syncMatch(ctx context.Context, m *Match, deletes *[]*Match) (action, error) {
+	if m.Xid > 0 && m.TaskWr.Xid > 0 && m.Asana.Xid != m.TaskWr.Xid {
+		return actNone, x.Errorf(x.Corrupt, "Xids should be matched: %+v", m)
+	}
+
+	act, err := planMatch(m)
+	if err != nil || act == actNone {
+		return act, err
+	}
+	if (act == actDeleteAsana || act == actDeleteTaskw) && deletes != nil {
+		*deletes = append(*deletes, m)
+		return actNone, nil
+	}
+
+	e := newEntry(m, act)
+	err = applyWithIntent(ctx, m, act, e)
+	if err != nil {
+		e.Error = err.Error()
+	}
+	journalAction(e)
+	return act, err
+}
+
+// applyMatch applies action act to the match, and records the resulting state of the task in e.
+func applyMatch(ctx context.Context, m *Match, act action, e *entry) error {
+	switch act {
+	case actDeleteTaskw:
+		// Make sure the task is really gone from Asana, and didn't just go missing from the results.
+		gone, err := asana.Gone(ctx, m.TaskWr.Xid)
+		if err != nil {
+			return errors.Wrap(err, "Confirm deletion from Asana")
 		}
+		if !gone {
+			return fmt.Errorf("Task %d still exists in Asana. Not deleting from Taskwarrior",
+				m.TaskWr.Xid)
+		}
+		fmt.Printf("Delete from Taskwarrior: [%q]\n", m.TaskWr.Name)
+		pushNotification("Delete", m.TaskWr.Name)
 
-		// Create in Asana.
+		if err := taskwarrior.Delete(m.TaskWr); err != nil {
+			return errors.Wrap(err, "Delete from Taskwarrior")
+		}
+		if updated, err := taskwarrior.GetTask(m.TaskWr.Uuid); err == nil {
+			e.After.Taskw = &updated
+		}
+
+	case actCreateAsana:
 		fmt.Printf("Create in Asana: [%q]\n", m.TaskWr.Name)
-		asanaUpdated, err := asana.AddNew(m.TaskWr)
+		m.TaskWr.Depends = deps.forAsana(m.TaskWr, x.WarriorTask{})
+		asanaUpdated, err := asana.AddNew(ctx, m.TaskWr, func(xid uint64) {
+			// So the task can be linked, if we don't get to it.
+			if err := recordIntent(m, act, xid); err != nil {
+				log.Printf("Unable to record Asana task %d created for [%q]: %v", xid,
+					m.TaskWr.Name, err)
+			}
+		})
 		if err != nil {
 			return errors.Wrap(err, "create asana addnew")
 		}
+		deps.link(asanaUpdated.Xid, m.TaskWr.Uuid)
+		deps.set(asanaUpdated.Xid, asanaUpdated.Depends)
 
 		// Update TW with the Xid.
 		if err := taskwarrior.OverwriteUuid(asanaUpdated, m.TaskWr.Uuid); err != nil {
@@ -165,108 +289,163 @@ func syncMatch(m *Match, deleteFromAsana *[]*Match) error {
 		}
 
 		// Store Asana and Taskwarrior timestamps as of this sync.
-		storeInDb(asanaUpdated, taskwUpdated)
-		return nil
-	}
-
-	if m.TaskWr.Xid == 0 {
-		// No Asana xid found in Taskwarrior. So, create it.
+		e.Xid = asanaUpdated.Xid
+		e.After = snapshot{Asana: &asanaUpdated, Taskw: &taskwUpdated}
+		if err := storeInDb(asanaUpdated, taskwUpdated); err != nil {
+			return err
+		}
 
+	case actCreateTaskw:
 		fmt.Printf("Create in Taskwarrior: [%q]\n", m.Asana.Name)
 		pushNotification("Create", m.Asana.Name)
+		m.Asana.DependsUuid = deps.toUuids(m.Asana.Depends)
 		uuid, err := taskwarrior.AddNew(m.Asana)
 		if err != nil {
 			return errors.Wrap(err, "syncMatch create in taskwarrior")
 		}
 		if len(uuid) == 0 {
-			log.Fatalf("Unable to parse UUID of new task: %+v", m.Asana)
+			return errors.Errorf("Unable to parse UUID of new task: %+v", m.Asana)
 		}
+		deps.link(m.Asana.Xid, uuid)
 		updated, err := taskwarrior.GetTask(uuid)
 		if err != nil {
 			return err
 		}
 
 		// Store Asana and Taskwarrior timestamps as of this sync.
-		storeInDb(m.Asana, updated)
-		return nil
-	}
-
-	if m.Asana.Xid != m.TaskWr.Xid {
-		log.Fatalf("Xids should be matched: %+v\n", m)
-	}
-
-	// Task is present in both Asana and TW.
-	asanaTs, taskwTs := getSyncTimestamps(m.Asana.Xid, m.TaskWr.Uuid)
+		e.Uuid = uuid
+		e.After = snapshot{Asana: &m.Asana, Taskw: &updated}
+		if err := storeInDb(m.Asana, updated); err != nil {
+			return err
+		}
 
-	if approxAfter(m.Asana.Modified, asanaTs) {
-		// Asana was updated. Overwrite TW.
-		fmt.Printf("Overwrite Taskwarrior: [%q] [time diff: %v]\n",
-			m.Asana.Name, m.Asana.Modified.Sub(asanaTs))
+	case actOverwriteTaskw:
+		fmt.Printf("Overwrite Taskwarrior: [%q]\n", m.Asana.Name)
 		pushNotification("Update", m.Asana.Name)
 
-		if err := taskwarrior.OverwriteUuid(m.Asana, m.TaskWr.Uuid); err != nil {
+		if err := taskwarrior.OverwriteUuid(forTaskwarrior(m), m.TaskWr.Uuid); err != nil {
 			return errors.Wrap(err, "Overwrite Taskwarrior")
 		}
 		updated, err := taskwarrior.GetTask(m.TaskWr.Uuid)
 		if err != nil {
 			return errors.Wrap(err, "Overwrite Taskwarrior GetTask")
 		}
-		storeInDb(m.Asana, updated)
-		return nil
-	}
-
-	// If task has been marked as deleted since the last modification.
-	if m.TaskWr.Deleted && approxAfter(m.TaskWr.Modified, taskwTs) {
-		if deleteFromAsana != nil {
-			*deleteFromAsana = append(*deleteFromAsana, m)
-			return nil
+		e.After = snapshot{Asana: &m.Asana, Taskw: &updated}
+		if err := storeInDb(m.Asana, updated); err != nil {
+			return err
 		}
 
-		fmt.Printf("Deleting task from Asana: [%q]\n", m.TaskWr.Name)
+	case actDeleteAsana:
+		pol, err := asana.Remove(ctx, m.Asana)
+		fmt.Printf("Deleting task from Asana (%s): [%q]\n", pol, m.TaskWr.Name)
 		pushNotification("Deleting from Asana", m.TaskWr.Name)
-		if err := asana.Delete(m.Xid); err != nil {
+		if err != nil {
 			return errors.Wrap(err, "Delete task from Asana")
 		}
 
-		// Don't delete from boltdb, but update the timestamps,
+		// Don't delete from db, but update the timestamps,
 		// so we don't reapply this deletion.
-		// We don't need to retrieve Asana task back, because we won't be able to. It has been deleted.
+		if updated, err := asana.GetOneTask(ctx, m.Xid); err == nil {
+			// Soft deleted. The task still exists in Asana.
+			e.After = snapshot{Asana: &updated, Taskw: &m.TaskWr}
+			if err := storeInDb(updated, m.TaskWr); err != nil {
+				return err
+			}
+			break
+		}
+		// We can't retrieve Asana task back, because it has been deleted.
 		// If the task gets undeleted, Asana won't modify the timestamp. So, let's set it to zero
 		// in our records, so if it comes back, we'll see it as an update.
 		m.Asana.Modified = time.Time{}
-		storeInDb(m.Asana, m.TaskWr)
-		return nil
-	}
+		e.After = snapshot{Taskw: &m.TaskWr}
+		if err := storeInDb(m.Asana, m.TaskWr); err != nil {
+			return err
+		}
 
-	if approxAfter(m.TaskWr.Modified, taskwTs) {
-		// TW was updated. Overwrite Asana.
-		fmt.Printf("Overwrite Asana: [%q] [time diff: %v]\n",
-			m.TaskWr.Name, m.TaskWr.Modified.Sub(taskwTs))
+	case actOverwriteAsana:
+		fmt.Printf("Overwrite Asana: [%q]\n", m.TaskWr.Name)
 
-		if err := asana.UpdateTask(m.TaskWr, m.Asana); err != nil {
+		m.TaskWr.Depends = deps.forAsana(m.TaskWr, m.Asana)
+		if err := asana.UpdateTask(ctx, m.TaskWr, m.Asana); err != nil {
 			return errors.Wrap(err, "syncMatch overwrite asana")
 		}
-		updated, err := asana.GetOneTask(m.Xid)
+		updated, err := asana.GetOneTask(ctx, m.Xid)
 		if err != nil {
 			return errors.Wrap(err, "syncMatch GetOneTask")
 		}
-		storeInDb(updated, m.TaskWr)
-		return nil
+		deps.set(updated.Xid, updated.Depends)
+		e.After = snapshot{Asana: &updated, Taskw: &m.TaskWr}
+		if err := storeInDb(updated, m.TaskWr); err != nil {
+			return err
+		}
+
+	case actSyncDepends:
+		return syncDepends(ctx, m, e)
+
+	case actRelinkTaskw:
+		return relinkTaskw(m, e)
 	}
 	return nil
 }
 
-func runSync() {
-	atasks, err := asana.GetTasks()
-	// atasks, err := asana.GetTasks(1)
-	if err != nil {
-		log.Fatalf("%+v", err)
+// syncDepends brings dependencies in sync, when neither side has been modified. Dependencies
+// can go out of sync if they refer to tasks which weren't present on the other side, when the
+// task was last synced.
+func syncDepends(ctx context.Context, m *Match, e *entry) error {
+	merged := deps.merged(m.Asana, m.TaskWr)
+	updateAsana := !sameIds(merged, m.Asana.Depends)
+	uuids := deps.forTaskwarrior(merged, m.TaskWr)
+	updateTaskw := !sameUuids(uuids, m.TaskWr.DependsUuid)
+
+	fmt.Printf("Sync dependencies: [%q]\n", m.Asana.Name)
+	at := m.Asana
+	if updateAsana {
+		want := m.Asana
+		want.Depends = merged
+		if err := asana.UpdateTask(ctx, want, m.Asana); err != nil {
+			return errors.Wrap(err, "syncDepends UpdateTask")
+		}
+		var err error
+		if at, err = asana.GetOneTask(ctx, m.Xid); err != nil {
+			return errors.Wrap(err, "syncDepends GetOneTask")
+		}
+		deps.set(at.Xid, at.Depends)
+	}
+
+	tt := m.TaskWr
+	if updateTaskw {
+		want := forTaskwarrior(m)
+		want.DependsUuid = uuids
+		if err := taskwarrior.OverwriteUuid(want, m.TaskWr.Uuid); err != nil {
+			return errors.Wrap(err, "syncDepends OverwriteUuid")
+		}
+		var err error
+		if tt, err = taskwarrior.GetTask(m.TaskWr.Uuid); err != nil {
+			return errors.Wrap(err, "syncDepends GetTask")
+		}
+	}
+	e.After = snapshot{Asana: &at, Taskw: &tt}
+	return storeInDb(at, tt)
+}
+
+// fetchMatches retrieves tasks from both Asana and Taskwarrior, and matches them up. If resolve,
+// the intents left behind by earlier syncs are resolved first, which writes to the db. Only a sync
+// holding the instance lock may do that.
+func fetchMatches(ctx context.Context, resolve bool) ([]*Match, error) {
+	atasks, err := asana.GetTasks(ctx)
+	fetchErr = nil
+	if ferr, ok := err.(*asana.FetchError); ok {
+		// Sync what we got. Tasks missing from these projects won't be considered deleted.
+		fetchErr = ferr
+		log.Printf("%v", ferr)
+	} else if err != nil {
+		return nil, errors.Wrap(err, "asana.GetTasks")
 	}
 	fmt.Printf("%27s: %d active\n", "Asana results found", len(atasks))
 
 	twtasks, err := taskwarrior.GetTasks()
 	if err != nil {
-		log.Fatal(err)
+		return nil, errors.Wrap(err, "taskwarrior.GetTasks")
 	}
 
 	deleted := 0
@@ -278,31 +457,96 @@ func runSync() {
 	fmt.Printf("%27s: %d active, %d deleted\n",
 		"Taskwarrior results found", len(twtasks)-deleted, deleted)
 
+	if resolve {
+		if err := recoverIntents(atasks, twtasks); err != nil {
+			return nil, errors.Wrap(err, "recoverIntents")
+		}
+	}
+	if unfinished, err = unfinishedCreates(); err != nil {
+		return nil, errors.Wrap(err, "unfinishedCreates")
+	}
+	stale, err := applyRelinks(atasks, twtasks)
+	if err != nil {
+		return nil, err
+	}
+	deps = newDepends(atasks, twtasks)
+	lastFetch = time.Now()
 	matches := generateMatches(atasks, twtasks)
-	deletes := make([]*Match, 0, 10)
 	for _, m := range matches {
-		if err := syncMatch(m, &deletes); err != nil {
-			log.Printf("syncMatch error: %v %+v", err, m)
+		m.Relink = m.Xid > 0 && stale[m.TaskWr.Uuid]
+	}
+	return matches, nil
+}
+
+func runSync(ctx context.Context) *syncStats {
+	stats := &syncStats{Id: startRun(), Start: time.Now(), Actions: make(map[string]int)}
+	defer func() {
+		stats.End = time.Now()
+		saveStats(stats)
+		if err := pruneJournal(); err != nil {
+			log.Printf("Unable to prune journal: %v", err)
 		}
+	}()
+
+	matches, err := fetchMatches(ctx, true)
+	if err != nil {
+		log.Printf("Unable to fetch tasks: %+v", err)
+		stats.Errors = append(stats.Errors, err.Error())
+		return stats
+	}
+	stats.Matches = len(matches)
+	if fetchErr != nil {
+		stats.Errors = append(stats.Errors, fetchErr.Error())
 	}
+	applyMatches(ctx, matches, stats, false)
+	return stats
+}
 
-	if len(deletes) > *maxDeletes {
-		fmt.Printf(`
-==========================================
-Task deletions requested from Asana : %d
-Max allowed per sync                : %d
-Most likely this is a mistake!
-If so, please run 'rm -f ~/.task/*' to clean up Taskwarrior (or wherever else you store it's state).
-If you genuinely want to delete all these tasks, then set the 'deletes' flag to a higher value.
-Crashing to avoid mass deletes from Asana!
-==========================================
-`, len(deletes), *maxDeletes)
-		os.Exit(1)
+// applyMatches syncs the matches, and records the actions taken and errors in stats. If partial,
+// the matches are only some of the tasks, and deletions are left for the next full sync. The
+// quarantine can only be checked against all of them.
+func applyMatches(ctx context.Context, matches []*Match, stats *syncStats, partial bool) {
+	// record returns false if the sync should stop, because the rest of the tasks would fail too.
+	record := func(m *Match, act action, err error) bool {
+		if err == nil {
+			if act != actNone {
+				stats.Actions[act.String()]++
+			}
+			return true
+		}
+		log.Printf("syncMatch error: %v %+v", err, m)
+		stats.Errors = append(stats.Errors, err.Error())
+		switch x.KindOf(err) {
+		case x.Auth, x.RateLimited, x.Unavailable:
+			log.Printf("Stopping this sync: %v", err)
+			return false
+		}
+		if ctx.Err() != nil {
+			log.Printf("Stopping this sync: %v", ctx.Err())
+			return false
+		}
+		// Skip the task. Conflicts and missing tasks would be picked up again by the next sync.
+		return true
 	}
-	for _, m := range deletes {
-		if err := syncMatch(m, nil); err != nil {
-			log.Printf("syncMatch error: %v %+v", err, m)
+
+	deletes, stopped := syncMatches(ctx, matches, record)
+	if stopped {
+		if shuttingDown() {
+			stats.Errors = append(stats.Errors, "Shut down before syncing all tasks")
 		}
+		return
+	}
+	if partial {
+		if len(deletes) > 0 {
+			fmt.Printf("Leaving %d deletions for the next full sync.\n", len(deletes))
+		}
+		fmt.Println("Changed tasks synced up. DONE.")
+		return
+	}
+
+	if err := guardDeletes(ctx, deletes, stats, record); err != nil {
+		log.Printf("guardDeletes error: %v", err)
+		stats.Errors = append(stats.Errors, err.Error())
 	}
 
 	fmt.Println("All synced up. DONE.")
@@ -322,66 +566,146 @@ func pushNotification(title, text string) {
 
 }
 
-func processNotifications() {
-	ni := time.Duration(*notifyInterval)
-	ticker := time.NewTicker(ni * time.Second)
+// processNotifications pushes the notifications, at most one every interval seconds. A new interval
+// can be sent on intervals, when the config is reloaded. Once quit is closed, it pushes out the
+// pending notifications, and closes flushed.
+func processNotifications(interval int, intervals <-chan int, quit <-chan struct{},
+	flushed chan<- struct{}) {
+
+	newTicker := func() *time.Ticker {
+		ni := time.Duration(interval)
+		if ni <= 0 {
+			// Notifications are dropped. Tickers need a positive interval.
+			ni = 1
+		}
+		return time.NewTicker(ni * time.Second)
+	}
+	ticker := newTicker()
+	defer func() {
+		ticker.Stop()
+	}()
 	l := make([]notification, 0, 10)
+	push := func() {
+		if len(l) == 0 {
+			// pass
+
+		} else if len(l) == 1 {
+			n := l[0]
+			notify.Push("Asanawarrior "+n.Title, n.Text, "", notificator.UR_NORMAL)
+
+		} else {
+			notify.Push("Asanawarrior "+l[0].Title,
+				fmt.Sprintf("%q and %d more updates", l[0].Text, len(l)-1), "", notificator.UR_NORMAL)
+		}
+		l = l[:0]
+	}
 	for {
 		select {
 		case <-ticker.C:
-			if len(l) == 0 {
-				// pass
-
-			} else if len(l) == 1 {
-				n := l[0]
-				notify.Push("Asanawarrior "+n.Title, n.Text, "", notificator.UR_NORMAL)
-
-			} else {
-				notify.Push("Asanawarrior "+l[0].Title,
-					fmt.Sprintf("%q and %d more updates", l[0].Text, len(l)-1), "", notificator.UR_NORMAL)
-			}
-			l = l[:0]
+			push()
 
 		case n := <-notifications:
-			if *notifyInterval > 0 {
+			if interval > 0 {
 				l = append(l, n)
 			}
+
+		case interval = <-intervals:
+			push()
+			ticker.Stop()
+			ticker = newTicker()
+
+		case <-quit:
+			// Pick up the notifications queued so far, and push them out.
+			for len(notifications) > 0 {
+				if n := <-notifications; interval > 0 {
+					l = append(l, n)
+				}
+			}
+			push()
+			close(flushed)
+			return
 		}
 	}
 }
 
 func main() {
+	flag.Usage = usage
 	flag.Parse()
+	if flag.Arg(0) == "hook" {
+		// Runs from Taskwarrior on every add and modify. It must be quick, and print nothing but
+		// the task. With a broken config file, the default -socket is used.
+		loadConfig()
+		if err := runHook(context.Background(), nil); err != nil {
+			log.Fatalf("hook: %v", err)
+		}
+		return
+	}
 	fmt.Println("Asanawarrior v1.0 - Bringing the power of Taskwarrior to Asana")
-	notify = notificator.New(notificator.Options{
-		AppName: "Asanawarrior",
-	})
-	go processNotifications()
+	if err := loadConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if err := asana.LoadToken(); err != nil {
+		log.Fatalf("Unable to load token: %v", err)
+	}
+
+	name := flag.Arg(0)
+	if len(name) == 0 {
+		name = "daemon"
+	}
+	cmd, ok := findCommand(name)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command: %q\n\n", name)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if cmd.lock {
+		if err := lockInstance(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	defer func() {
+		if instance != nil {
+			instance.release()
+		}
+	}()
+	// log.Fatalf skips the deferred calls. Release the lock first, so it isn't taken for stale.
+	fatalf := func(format string, args ...interface{}) {
+		if instance != nil {
+			instance.release()
+		}
+		log.Fatalf(format, args...)
+	}
 
 	var err error
-	db, err = bolt.Open(*dbpath, 0600, nil)
+	db, err = openStore(*dbpath)
 	if err != nil {
-		log.Fatalf("Unable to open bolt db at %v. Error: %v", *dbpath, err)
+		fatalf("Unable to open %s db at %v. Error: %v", *storeKind, *dbpath, err)
 	}
 	defer db.Close()
-	db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(bucketName)
-		if err != nil {
-			log.Fatalf("Unable to create bucket in bolt db.")
-		}
-		return nil
-	})
-
-	// Initiate a sync right away.
-	fmt.Println()
-	fmt.Println("Starting sync at", time.Now())
-	runSync()
-
-	// And then do it at regular intervals.
-	ticker := time.NewTicker(time.Duration(*duration) * time.Minute)
-	for t := range ticker.C {
-		fmt.Println()
-		fmt.Println("Starting sync at", t)
-		runSync()
+	if err := db.Migrate(); err != nil {
+		fatalf("Unable to migrate db: %v", err)
+	}
+
+	if err := asana.UseOAuth(db); err != nil {
+		fatalf("Unable to load OAuth token: %v", err)
+	}
+	if cmd.asana {
+		if err := asana.Validate(); err != nil {
+			fatalf("Invalid configuration: %v", err)
+		}
+	}
+	var args []string
+	if flag.NArg() > 1 {
+		args = flag.Args()[1:]
+	}
+	ctx := context.Background()
+	if cmd.name == "daemon" || cmd.name == "sync" {
+		// Other commands exit right away on a signal, for e.g. at a prompt.
+		ctx = handleShutdown()
+	}
+	if err := cmd.run(ctx, args); err != nil {
+		db.Close()
+		fatalf("%s: %v", cmd.name, err)
 	}
 }
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/manishrjain/asanawarrior/x"
+)
+
+func TestPlanMatchDepends(t *testing.T) {
+	done := useTestDb(t)
+	defer done()
+	deps = testDepends()
+	defer func() { deps = newDepends(nil, nil) }()
+
+	synced := time.Date(2017, 3, 1, 10, 0, 0, 0, time.UTC)
+	if err := db.PutMapping(&mapping{Xid: 4, Uuid: "u4", AsanaTs: synced,
+		TaskwTs: synced}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		asana  []uint64
+		taskwr []string
+		want   action
+	}{
+		{"in sync", []uint64{3}, []string{"u3"}, actNone},
+		// u5 is in Taskwarrior only, for e.g. in a project which isn't synced.
+		{"out of scope", nil, []string{"u5"}, actNone},
+		{"out of scope and in sync", []uint64{3}, []string{"u3", "u5"}, actNone},
+		{"missing in asana", nil, []string{"u3"}, actSyncDepends},
+		{"missing in taskwarrior", []uint64{3}, []string{"u5"}, actSyncDepends},
+	}
+	for _, tt := range tests {
+		m := &Match{
+			Xid:    4,
+			Asana:  x.WarriorTask{Xid: 4, Modified: synced, Depends: tt.asana},
+			TaskWr: x.WarriorTask{Xid: 4, Uuid: "u4", Modified: synced, DependsUuid: tt.taskwr},
+		}
+		act, err := planMatch(m)
+		if err != nil {
+			t.Fatalf("%s: planMatch: %v", tt.name, err)
+		}
+		if act != tt.want {
+			t.Errorf("%s: planMatch = %v, want %v", tt.name, act, tt.want)
+		}
+	}
+}
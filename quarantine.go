@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/manishrjain/asanawarrior/taskwarrior"
+	"github.com/pkg/errors"
+)
+
+const (
+	heldPending  = "pending"
+	heldApproved = "approved"
+	heldRejected = "rejected"
+)
+
+// held is a deletion waiting in quarantine.
+type held struct {
+	Key    string    `json:"key"`
+	Action string    `json:"action"`
+	Name   string    `json:"name"`
+	Xid    uint64    `json:"xid"`
+	Uuid   string    `json:"uuid"`
+	Run    uint64    `json:"run"`
+	Since  time.Time `json:"since"`
+	State  string    `json:"state"`
+}
+
+func heldKey(m *Match, act action) string {
+	return act.String() + ":" + m.TaskWr.Uuid
+}
+
+// rejectDelete undoes the deletion on the side it happened, instead of propagating it to the
+// other side.
+func rejectDelete(ctx context.Context, m *Match, act action) error {
+	e := newEntry(m, act)
+	e.Action = "reject-" + act.String()
+	var err error
+	switch act {
+	case actDeleteAsana:
+		// Bring the task back in Taskwarrior, from Asana.
+		err = applyWithIntent(ctx, m, actOverwriteTaskw, e)
+	case actDeleteTaskw:
+		// Unlink the task, so it gets re-created in Asana on the next sync.
+		wt := m.TaskWr
+		if err = db.DeleteMapping(wt.Xid, wt.Uuid); err != nil {
+			break
+		}
+		wt.Xid = 0
+		if err = taskwarrior.Restore(wt); err == nil {
+			if updated, terr := taskwarrior.GetTask(wt.Uuid); terr == nil {
+				e.After.Taskw = &updated
+			}
+		}
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	journalAction(e)
+	return err
+}
+
+// guardDeletes applies the deletions found during a sync. Approved and rejected deletions in
+// quarantine get resolved. New deletions get quarantined, if there are more than -deletes of them
+// in either direction.
+func guardDeletes(ctx context.Context, deletes []*Match, stats *syncStats,
+	record func(m *Match, act action, err error) bool) error {
+
+	hs, err := db.Held()
+	if err != nil {
+		return errors.Wrap(err, "loadHeld")
+	}
+	seen := make(map[string]bool)
+	fresh := make(map[action][]*Match)
+	var resolved []string
+	for _, m := range deletes {
+		act, err := planMatch(m)
+		if err != nil {
+			record(m, act, err)
+			continue
+		}
+		key := heldKey(m, act)
+		seen[key] = true
+		h, has := hs[key]
+		switch {
+		case !has:
+			fresh[act] = append(fresh[act], m)
+		case h.State == heldApproved:
+			act, err := syncMatch(ctx, m, nil)
+			if err == nil {
+				resolved = append(resolved, key)
+			}
+			if !record(m, act, err) {
+				return db.DeleteHeld(resolved...)
+			}
+		case h.State == heldRejected:
+			err := rejectDelete(ctx, m, act)
+			if err == nil {
+				stats.Actions["reject-"+act.String()]++
+				resolved = append(resolved, key)
+			} else if !record(m, act, err) {
+				return db.DeleteHeld(resolved...)
+			}
+		default:
+			stats.Quarantined++
+		}
+	}
+
+	for _, act := range []action{actDeleteAsana, actDeleteTaskw} {
+		ms := fresh[act]
+		if len(ms) <= *maxDeletes {
+			for _, m := range ms {
+				act, err := syncMatch(ctx, m, nil)
+				if !record(m, act, err) {
+					return db.DeleteHeld(resolved...)
+				}
+			}
+			continue
+		}
+		var add []*held
+		for _, m := range ms {
+			name := m.TaskWr.Name
+			if len(name) == 0 {
+				name = m.Asana.Name
+			}
+			add = append(add, &held{Key: heldKey(m, act), Action: act.String(), Name: name,
+				Xid: m.TaskWr.Xid, Uuid: m.TaskWr.Uuid, Run: stats.Id, Since: time.Now(),
+				State: heldPending})
+		}
+		if err := db.PutHeld(add...); err != nil {
+			return errors.Wrap(err, "putHeld")
+		}
+		stats.Quarantined += len(add)
+		fmt.Printf(`
+==========================================
+Task deletions requested (%s) : %d
+Max allowed per sync          : %d
+Most likely this is a mistake! These deletions have been quarantined.
+Run 'asanawarrior quarantine' to review, and approve or reject them.
+==========================================
+`, act, len(add), *maxDeletes)
+		pushNotification("Deletions quarantined",
+			fmt.Sprintf("%d tasks (%s). Run 'asanawarrior quarantine'", len(add), act))
+	}
+
+	// Forget deletions which are no longer requested, for e.g. the task was restored.
+	for key := range hs {
+		if !seen[key] {
+			resolved = append(resolved, key)
+		}
+	}
+	return db.DeleteHeld(resolved...)
+}
+
+// runQuarantine lists the deletions in quarantine, or marks them as approved or rejected. These
+// are then applied on the next sync.
+func runQuarantine(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("quarantine", flag.ExitOnError)
+	approve := fs.Bool("approve", false, "Approve the deletions, so they get applied.")
+	reject := fs.Bool("reject", false, "Reject the deletions, so the deleted tasks get restored.")
+	all := fs.Bool("all", false, "Apply -approve or -reject to all deletions in quarantine.")
+	fs.Parse(args)
+
+	if *approve && *reject {
+		return errors.New("Only one of -approve and -reject can be set")
+	}
+	hs, err := db.Held()
+	if err != nil {
+		return err
+	}
+	if !*approve && !*reject {
+		for _, h := range hs {
+			fmt.Printf("%-8s %-20s [%q] xid:%d uuid:%s since %s\n", h.State, h.Action, h.Name,
+				h.Xid, h.Uuid, h.Since.Format("2006-01-02 15:04:05"))
+		}
+		fmt.Printf("\n%d deletions in quarantine.\n", len(hs))
+		return nil
+	}
+	if !*all && fs.NArg() == 0 {
+		return errors.New("Specify the tasks by Asana id or Taskwarrior UUID (or prefix), or use -all")
+	}
+
+	state := heldApproved
+	if *reject {
+		state = heldRejected
+	}
+	var update []*held
+	for _, h := range hs {
+		if *all || matchesHeld(h, fs.Args()) {
+			h.State = state
+			update = append(update, h)
+		}
+	}
+	if err := db.PutHeld(update...); err != nil {
+		return err
+	}
+	fmt.Printf("%d deletions %s. They'll be applied on the next sync.\n", len(update), state)
+	return nil
+}
+
+func matchesHeld(h *held, ids []string) bool {
+	for _, id := range ids {
+		if xid, err := strconv.ParseUint(id, 10, 64); err == nil && xid == h.Xid {
+			return true
+		}
+		if strings.HasPrefix(h.Uuid, id) {
+			return true
+		}
+	}
+	return false
+}
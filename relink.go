@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/manishrjain/asanawarrior/asana"
+	"github.com/manishrjain/asanawarrior/taskwarrior"
+	"github.com/manishrjain/asanawarrior/x"
+	"github.com/pkg/errors"
+)
+
+// relinkWindow is how far apart the created times of a Taskwarrior and an Asana task can be, for
+// them to be considered the same task.
+const relinkWindow = time.Minute
+
+// relink repairs the link from a Taskwarrior task to its Asana task.
+type relink struct {
+	idx    int // Of the task in Taskwarrior results.
+	xid    uint64
+	fromDb bool // Link known from db. Otherwise, matched by name, project and created time.
+}
+
+// loadLinks returns the Asana id of every Taskwarrior task linked in the db, by UUID.
+func loadLinks() (map[string]uint64, error) {
+	mps, err := db.Mappings()
+	if err != nil {
+		return nil, err
+	}
+	links := make(map[string]uint64)
+	for _, mp := range mps {
+		links[mp.Uuid] = mp.Xid
+	}
+	return links, nil
+}
+
+// findRelinks finds Taskwarrior tasks which lost their link to Asana, or point to the wrong Asana
+// task. The db mapping is the source of truth, as long as its Asana task still exists. Tasks
+// unknown to the db are matched to Asana tasks not linked to any Taskwarrior task, by name, project
+// and created time.
+func findRelinks(atasks, twtasks []x.WarriorTask, links map[string]uint64) []relink {
+	inAsana := make(map[uint64]bool)
+	for _, at := range atasks {
+		inAsana[at.Xid] = true
+	}
+	var result []relink
+	linked := make(map[uint64]bool)
+	var unlinked []int
+	for i, t := range twtasks {
+		xid, has := links[t.Uuid]
+		switch {
+		case has && xid != t.Xid && inAsana[xid]:
+			result = append(result, relink{idx: i, xid: xid, fromDb: true})
+			linked[xid] = true
+		case t.Xid > 0:
+			linked[t.Xid] = true
+		case !t.Deleted:
+			unlinked = append(unlinked, i)
+		}
+	}
+
+	for _, i := range unlinked {
+		tw := twtasks[i]
+		var found []uint64
+		for _, at := range atasks {
+			if !linked[at.Xid] && sameTask(at, tw) {
+				found = append(found, at.Xid)
+			}
+		}
+		if len(found) != 1 {
+			// Don't guess, if there's more than one candidate.
+			continue
+		}
+		var others int
+		for _, j := range unlinked {
+			if j != i && sameTask(twtasks[j], tw) {
+				others++
+			}
+		}
+		if others > 0 {
+			continue
+		}
+		result = append(result, relink{idx: i, xid: found[0]})
+		linked[found[0]] = true
+	}
+	return result
+}
+
+// sameTask returns true if the tasks have the same name and project, and were created around the
+// same time.
+func sameTask(a, b x.WarriorTask) bool {
+	d := a.Created.Sub(b.Created)
+	return a.Name == b.Name && a.Project == b.Project && d < relinkWindow && d > -relinkWindow
+}
+
+// applyRelinks sets the Asana ids found by findRelinks in the Taskwarrior results, and returns the
+// UUIDs of tasks whose xid needs to be written back to Taskwarrior.
+func applyRelinks(atasks, twtasks []x.WarriorTask) (map[string]bool, error) {
+	links, err := loadLinks()
+	if err != nil {
+		return nil, errors.Wrap(err, "loadLinks")
+	}
+	stale := make(map[string]bool)
+	for _, r := range findRelinks(atasks, twtasks, links) {
+		t := &twtasks[r.idx]
+		if r.fromDb {
+			stale[t.Uuid] = true
+		} else {
+			fmt.Printf("Found Asana task %d for unlinked Taskwarrior task: [%q]\n", r.xid, t.Name)
+		}
+		// Without a record of the last sync, matches by name get overwritten from Asana, which
+		// stores the xid in Taskwarrior as well.
+		t.Xid = r.xid
+	}
+	return stale, nil
+}
+
+// relinkTaskw writes the xid known from the db back to the Taskwarrior task. The sync timestamps
+// are left as is, so any changes since the last sync get picked up.
+func relinkTaskw(m *Match, e *entry) error {
+	fmt.Printf("Relink Taskwarrior: [%q] to %d\n", m.TaskWr.Name, m.Xid)
+	wt := m.TaskWr
+	wt.Xid = m.Xid
+	if err := taskwarrior.Restore(wt); err != nil {
+		return errors.Wrap(err, "relink Restore")
+	}
+	updated, err := taskwarrior.GetTask(wt.Uuid)
+	if err != nil {
+		return errors.Wrap(err, "relink GetTask")
+	}
+	e.After.Taskw = &updated
+	return nil
+}
+
+// runRelink finds and repairs broken links between Taskwarrior and Asana tasks, or links a pair
+// of tasks given by -uuid and -xid.
+func runRelink(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("relink", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "Only show the links which would be repaired.")
+	yes := fs.Bool("yes", false, "Don't ask for confirmation.")
+	uuid := fs.String("uuid", "", "Link the Taskwarrior task with this UUID to the one set by -xid.")
+	xid := fs.Uint64("xid", 0, "Asana id of the task to link -uuid to.")
+	fs.Parse(args)
+
+	atasks, err := asana.GetTasks(ctx)
+	if _, ok := err.(*asana.FetchError); err != nil && !ok {
+		return errors.Wrap(err, "asana.GetTasks")
+	}
+	twtasks, err := taskwarrior.GetTasks()
+	if err != nil {
+		return errors.Wrap(err, "taskwarrior.GetTasks")
+	}
+
+	var rs []relink
+	if len(*uuid) > 0 || *xid > 0 {
+		if len(*uuid) == 0 || *xid == 0 {
+			return errors.New("Both -uuid and -xid are needed")
+		}
+		for i, t := range twtasks {
+			if t.Uuid == *uuid {
+				rs = append(rs, relink{idx: i, xid: *xid})
+			}
+		}
+		if len(rs) == 0 {
+			return x.Errorf(x.NotFound, "No Taskwarrior task with UUID: %v", *uuid)
+		}
+	} else {
+		links, err := loadLinks()
+		if err != nil {
+			return err
+		}
+		rs = findRelinks(atasks, twtasks, links)
+	}
+	if len(rs) == 0 {
+		fmt.Println("No broken links found.")
+		return nil
+	}
+
+	names := make(map[uint64]string)
+	for _, at := range atasks {
+		names[at.Xid] = at.Name
+	}
+	for _, r := range rs {
+		t := twtasks[r.idx]
+		how := "by name, project and created time"
+		if r.fromDb {
+			how = "from db"
+		}
+		fmt.Printf("[%q] %s xid: %d -> %d [%q] %s\n", t.Name, t.Uuid, t.Xid, r.xid,
+			names[r.xid], how)
+	}
+	if *dryRun {
+		return nil
+	}
+	if err := lockInstance(); err != nil {
+		return err
+	}
+	if !*yes && !confirm(fmt.Sprintf("Relink these %d tasks?", len(rs))) {
+		fmt.Println("Aborted.")
+		return nil
+	}
+
+	var failed int
+	for _, r := range rs {
+		t := twtasks[r.idx]
+		if !r.fromDb {
+			// Forget the last sync of either task, so the next sync overwrites Taskwarrior from
+			// Asana.
+			if err := db.DeleteMapping(r.xid, t.Uuid); err != nil {
+				return errors.Wrap(err, "DeleteMapping")
+			}
+		}
+		t.Xid = r.xid
+		if err := taskwarrior.Restore(t); err != nil {
+			fmt.Printf("Unable to relink [%q]: %v\n", t.Name, err)
+			failed++
+		}
+	}
+	fmt.Printf("Relinked %d of %d tasks.\n", len(rs)-failed, len(rs))
+	return nil
+}
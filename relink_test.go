@@ -0,0 +1,136 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/manishrjain/asanawarrior/x"
+)
+
+var relinkBase = time.Date(2017, 3, 1, 10, 0, 0, 0, time.UTC)
+
+func relinkTask(xid uint64, uuid, name string, created time.Duration) x.WarriorTask {
+	return x.WarriorTask{Xid: xid, Uuid: uuid, Name: name, Project: "Work",
+		Created: relinkBase.Add(created)}
+}
+
+func TestSameTask(t *testing.T) {
+	a := relinkTask(1, "", "Write docs", 0)
+	tests := []struct {
+		name string
+		b    x.WarriorTask
+		want bool
+	}{
+		{"same", relinkTask(0, "u1", "Write docs", 0), true},
+		{"created later", relinkTask(0, "u1", "Write docs", 30*time.Second), true},
+		{"created earlier", relinkTask(0, "u1", "Write docs", -30*time.Second), true},
+		{"created too late", relinkTask(0, "u1", "Write docs", 2*time.Minute), false},
+		{"created too early", relinkTask(0, "u1", "Write docs", -2*time.Minute), false},
+		{"other name", relinkTask(0, "u1", "Write tests", 0), false},
+		{"other project", x.WarriorTask{Name: "Write docs", Project: "Home", Created: relinkBase},
+			false},
+	}
+	for _, tt := range tests {
+		if got := sameTask(a, tt.b); got != tt.want {
+			t.Errorf("%s: sameTask = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFindRelinks(t *testing.T) {
+	tests := []struct {
+		name    string
+		atasks  []x.WarriorTask
+		twtasks []x.WarriorTask
+		links   map[string]uint64
+		want    []relink
+	}{
+		{
+			name:    "linked",
+			atasks:  []x.WarriorTask{relinkTask(1, "", "a", 0)},
+			twtasks: []x.WarriorTask{relinkTask(1, "u1", "a", 0)},
+			links:   map[string]uint64{"u1": 1},
+		},
+		{
+			name:    "lost xid",
+			atasks:  []x.WarriorTask{relinkTask(1, "", "a", 0)},
+			twtasks: []x.WarriorTask{relinkTask(0, "u1", "a", 0)},
+			links:   map[string]uint64{"u1": 1},
+			want:    []relink{{idx: 0, xid: 1, fromDb: true}},
+		},
+		{
+			name:    "wrong xid",
+			atasks:  []x.WarriorTask{relinkTask(1, "", "a", 0), relinkTask(2, "", "b", 0)},
+			twtasks: []x.WarriorTask{relinkTask(2, "u1", "a", 0)},
+			links:   map[string]uint64{"u1": 1},
+			want:    []relink{{idx: 0, xid: 1, fromDb: true}},
+		},
+		{
+			// The task was unlinked, for e.g. by rejecting a deletion, and the Asana task is gone.
+			name:    "stale mapping",
+			atasks:  []x.WarriorTask{relinkTask(2, "", "b", 0)},
+			twtasks: []x.WarriorTask{relinkTask(0, "u1", "a", 0)},
+			links:   map[string]uint64{"u1": 1},
+		},
+		{
+			name:    "by name",
+			atasks:  []x.WarriorTask{relinkTask(1, "", "a", 10*time.Second)},
+			twtasks: []x.WarriorTask{relinkTask(0, "u1", "a", 0)},
+			want:    []relink{{idx: 0, xid: 1}},
+		},
+		{
+			name:    "by name, after stale mapping",
+			atasks:  []x.WarriorTask{relinkTask(2, "", "a", 0)},
+			twtasks: []x.WarriorTask{relinkTask(0, "u1", "a", 0)},
+			links:   map[string]uint64{"u1": 1},
+			want:    []relink{{idx: 0, xid: 2}},
+		},
+		{
+			name:    "too far apart",
+			atasks:  []x.WarriorTask{relinkTask(1, "", "a", time.Hour)},
+			twtasks: []x.WarriorTask{relinkTask(0, "u1", "a", 0)},
+		},
+		{
+			name:    "ambiguous Asana tasks",
+			atasks:  []x.WarriorTask{relinkTask(1, "", "a", 0), relinkTask(2, "", "a", 0)},
+			twtasks: []x.WarriorTask{relinkTask(0, "u1", "a", 0)},
+		},
+		{
+			name:    "ambiguous Taskwarrior tasks",
+			atasks:  []x.WarriorTask{relinkTask(1, "", "a", 0)},
+			twtasks: []x.WarriorTask{relinkTask(0, "u1", "a", 0), relinkTask(0, "u2", "a", 0)},
+		},
+		{
+			name:   "Asana task linked elsewhere",
+			atasks: []x.WarriorTask{relinkTask(1, "", "a", 0)},
+			twtasks: []x.WarriorTask{relinkTask(1, "u1", "a", 0),
+				relinkTask(0, "u2", "a", 0)},
+		},
+		{
+			name:    "Asana task linked elsewhere in db",
+			atasks:  []x.WarriorTask{relinkTask(1, "", "a", 0)},
+			twtasks: []x.WarriorTask{relinkTask(0, "u1", "a", 0), relinkTask(0, "u2", "a", 0)},
+			links:   map[string]uint64{"u1": 1},
+			want:    []relink{{idx: 0, xid: 1, fromDb: true}},
+		},
+		{
+			name:    "deleted",
+			atasks:  []x.WarriorTask{relinkTask(1, "", "a", 0)},
+			twtasks: []x.WarriorTask{{Uuid: "u1", Name: "a", Project: "Work", Deleted: true}},
+		},
+	}
+	for _, tt := range tests {
+		links := tt.links
+		if links == nil {
+			links = make(map[string]uint64)
+		}
+		got := findRelinks(tt.atasks, tt.twtasks, links)
+		if len(got) == 0 && len(tt.want) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: findRelinks = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
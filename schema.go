@@ -0,0 +1,52 @@
+package main
+
+import (
+	"time"
+
+	"github.com/manishrjain/asanawarrior/asana"
+	"github.com/manishrjain/asanawarrior/x"
+	"github.com/pkg/errors"
+)
+
+// schemaVersion is the version of the sync state schema, which stores a mapping per linked task.
+// Stores get migrated to it on startup.
+const schemaVersion = 2
+
+// mapping links an Asana task to its Taskwarrior task, along with their state as of the last sync.
+type mapping struct {
+	Xid       uint64    `json:"xid"`
+	Uuid      string    `json:"uuid"`
+	Workspace string    `json:"workspace,omitempty"`
+	AsanaTs   time.Time `json:"asana_modified"`
+	TaskwTs   time.Time `json:"taskw_modified"`
+	Synced    time.Time `json:"synced"`
+	Last      snapshot  `json:"last"`
+}
+
+// storeInDb links the tasks, and records their state as of this sync. It's safe for concurrent
+// use, as the mapping is written in a single store operation.
+func storeInDb(asanaTask, twTask x.WarriorTask) error {
+	mp := &mapping{
+		Xid:       asanaTask.Xid,
+		Uuid:      twTask.Uuid,
+		Workspace: asana.Domain(),
+		AsanaTs:   asanaTask.Modified,
+		TaskwTs:   twTask.Modified,
+		Synced:    time.Now(),
+		Last:      snapshot{Asana: &asanaTask, Taskw: &twTask},
+	}
+	if err := db.PutMapping(mp); err != nil {
+		return errors.Wrap(err, "Write to db")
+	}
+	return nil
+}
+
+// getSyncTimestamps returns the Asana and Taskwarrior modification times of the task, as of its
+// last sync. Returns false if the tasks were never synced together.
+func getSyncTimestamps(xid uint64, uuid string) (time.Time, time.Time, bool, error) {
+	mp, err := db.GetMapping(xid)
+	if err != nil || mp == nil || mp.Uuid != uuid {
+		return time.Time{}, time.Time{}, false, err
+	}
+	return mp.AsanaTs, mp.TaskwTs, true, nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// stopping is closed on the first SIGINT or SIGTERM. A sync in progress finishes the tasks in
+// flight, but doesn't pick up new ones.
+var stopping = make(chan struct{})
+
+// shuttingDown returns true once a shutdown has been requested.
+func shuttingDown() bool {
+	select {
+	case <-stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// handleShutdown returns a context for requests to Asana. The first SIGINT or SIGTERM closes
+// stopping. The next one cancels the context, abandoning requests in flight. Any more signals
+// kill the process as usual.
+func handleShutdown() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigc
+		fmt.Printf("\nReceived %v. Finishing the tasks in flight. Repeat to cancel them.\n", sig)
+		close(stopping)
+
+		<-sigc
+		signal.Stop(sigc)
+		fmt.Println("Cancelling requests in flight.")
+		cancel()
+	}()
+	return ctx
+}
+
+// daemonSignals delivers SIGHUP on reload, to reload the config file, and SIGUSR1 on trigger, to
+// sync right away.
+func daemonSignals() (reload, trigger chan os.Signal) {
+	reload = make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	trigger = make(chan os.Signal, 1)
+	signal.Notify(trigger, syscall.SIGUSR1)
+	return reload, trigger
+}
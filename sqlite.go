@@ -0,0 +1,513 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/manishrjain/asanawarrior/asana"
+	"github.com/manishrjain/asanawarrior/x"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+)
+
+// sqliteSchema keeps the fields worth querying in columns, along with the full record as JSON.
+// For e.g.:
+//
+//	sqlite3 asanawarrior.sqlite "SELECT time, action, name FROM actions WHERE run = 42"
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS meta (
+	key   TEXT PRIMARY KEY,
+	value TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS mappings (
+	xid            INTEGER PRIMARY KEY,
+	uuid           TEXT NOT NULL UNIQUE,
+	workspace      TEXT NOT NULL,
+	asana_modified TEXT NOT NULL,
+	taskw_modified TEXT NOT NULL,
+	synced         TEXT NOT NULL,
+	last           TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS runs (
+	id          INTEGER PRIMARY KEY AUTOINCREMENT,
+	start       TEXT,
+	end         TEXT,
+	matches     INTEGER,
+	errors      INTEGER,
+	undo        INTEGER,
+	data        TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS actions (
+	seq    INTEGER PRIMARY KEY AUTOINCREMENT,
+	run    INTEGER NOT NULL,
+	time   TEXT NOT NULL,
+	action TEXT NOT NULL,
+	name   TEXT NOT NULL,
+	xid    INTEGER,
+	uuid   TEXT,
+	error  TEXT,
+	data   TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS actions_run ON actions(run);
+CREATE TABLE IF NOT EXISTS quarantine (
+	key   TEXT PRIMARY KEY,
+	state TEXT NOT NULL,
+	data  TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS intents (
+	key    TEXT PRIMARY KEY,
+	action TEXT NOT NULL,
+	data   TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS oauth (
+	id   INTEGER PRIMARY KEY CHECK (id = 1),
+	data TEXT NOT NULL
+);
+`
+
+// sqliteStore keeps the sync state in a SQLite db, so it can be inspected with standard tools.
+type sqliteStore struct {
+	db   *sql.DB
+	path string
+}
+
+func openSqlite(path string) (*sqliteStore, error) {
+	// Sync workers write concurrently. Transactions take the write lock upfront, and wait for it
+	// instead of failing.
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000&_txlock=immediate")
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqliteStore{db: db, path: path}, nil
+}
+
+// Suspend is a no-op. Other processes can use the db while it's open.
+func (s *sqliteStore) Suspend() error {
+	return nil
+}
+
+func (s *sqliteStore) Resume() error {
+	return nil
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// inTx runs fn in a transaction, which is committed if fn returns nil.
+func (s *sqliteStore) inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func fmtTime(t time.Time) string {
+	return t.Format(time.RFC3339Nano)
+}
+
+func (s *sqliteStore) Version() (int, error) {
+	var exists int
+	if err := s.db.QueryRow(`SELECT count(*) FROM sqlite_master WHERE type = 'table' AND
+		name = 'meta'`).Scan(&exists); err != nil || exists == 0 {
+		return 0, err
+	}
+	var val string
+	err := s.db.QueryRow(`SELECT value FROM meta WHERE key = 'version'`).Scan(&val)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.Atoi(val)
+	if err != nil {
+		return 0, x.Errorf(x.Corrupt, "Invalid schema version: %q", val)
+	}
+	return v, nil
+}
+
+// Migrate creates the tables in an empty db. There are no older versions of the SQLite schema.
+func (s *sqliteStore) Migrate() error {
+	v, err := s.Version()
+	if err != nil {
+		return err
+	}
+	if v > schemaVersion {
+		return fmt.Errorf("Db schema version %d is newer than supported version %d. Please upgrade",
+			v, schemaVersion)
+	}
+	return s.inTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(sqliteSchema); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`INSERT OR REPLACE INTO meta (key, value) VALUES ('version', ?)`,
+			strconv.Itoa(schemaVersion))
+		return err
+	})
+}
+
+func (s *sqliteStore) Backup() (string, error) {
+	backup := fmt.Sprintf("%s.%s.bak", s.path, time.Now().Format("20060102T150405"))
+	if _, err := s.db.Exec(`VACUUM INTO ?`, backup); err != nil {
+		return "", errors.Wrap(err, "Unable to backup db")
+	}
+	return backup, nil
+}
+
+func (s *sqliteStore) GetMapping(xid uint64) (*mapping, error) {
+	mps, err := s.queryMappings(`SELECT xid, uuid, workspace, asana_modified, taskw_modified,
+		synced, last FROM mappings WHERE xid = ?`, int64(xid))
+	if err != nil || len(mps) == 0 {
+		return nil, err
+	}
+	return &mps[0], nil
+}
+
+func (s *sqliteStore) queryMappings(query string, args ...interface{}) ([]mapping, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []mapping
+	for rows.Next() {
+		var mp mapping
+		var xid int64
+		var ats, tts, synced, last string
+		if err := rows.Scan(&xid, &mp.Uuid, &mp.Workspace, &ats, &tts, &synced,
+			&last); err != nil {
+			return nil, err
+		}
+		mp.Xid = uint64(xid)
+		if mp.AsanaTs, err = time.Parse(time.RFC3339Nano, ats); err != nil {
+			return nil, x.Errorf(x.Corrupt, "Invalid asana ts: %q for %v", ats, xid)
+		}
+		if mp.TaskwTs, err = time.Parse(time.RFC3339Nano, tts); err != nil {
+			return nil, x.Errorf(x.Corrupt, "Invalid taskwarrior ts: %q for %v", tts, mp.Uuid)
+		}
+		mp.Synced, _ = time.Parse(time.RFC3339Nano, synced)
+		if err := json.Unmarshal([]byte(last), &mp.Last); err != nil {
+			return nil, x.Errorf(x.Corrupt, "Invalid mapping for %d: %v", xid, err)
+		}
+		result = append(result, mp)
+	}
+	return result, rows.Err()
+}
+
+func putSqliteMapping(ex execer, mp *mapping) error {
+	last, err := json.Marshal(mp.Last)
+	if err != nil {
+		return err
+	}
+	// Replacing on conflict drops previous links of either task.
+	_, err = ex.Exec(`INSERT OR REPLACE INTO mappings (xid, uuid, workspace, asana_modified,
+		taskw_modified, synced, last) VALUES (?, ?, ?, ?, ?, ?, ?)`, int64(mp.Xid), mp.Uuid,
+		mp.Workspace, fmtTime(mp.AsanaTs), fmtTime(mp.TaskwTs), fmtTime(mp.Synced), string(last))
+	return err
+}
+
+func (s *sqliteStore) PutMapping(mp *mapping) error {
+	return putSqliteMapping(s.db, mp)
+}
+
+func (s *sqliteStore) DeleteMapping(xid uint64, uuid string) error {
+	_, err := s.db.Exec(`DELETE FROM mappings WHERE xid = ? OR uuid = ?`, int64(xid), uuid)
+	return err
+}
+
+func (s *sqliteStore) Mappings() ([]mapping, error) {
+	return s.queryMappings(`SELECT xid, uuid, workspace, asana_modified, taskw_modified, synced,
+		last FROM mappings ORDER BY xid`)
+}
+
+func (s *sqliteStore) NextRun() (uint64, error) {
+	res, err := s.db.Exec(`INSERT INTO runs (data) VALUES ('{}')`)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	return uint64(id), err
+}
+
+func saveSqliteRun(ex execer, r *syncStats) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = ex.Exec(`INSERT OR REPLACE INTO runs (id, start, end, matches, errors, undo, data)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`, int64(r.Id), fmtTime(r.Start), fmtTime(r.End), r.Matches,
+		len(r.Errors), int64(r.Undo), string(data))
+	return err
+}
+
+func (s *sqliteStore) SaveRun(r *syncStats) error {
+	return saveSqliteRun(s.db, r)
+}
+
+func (s *sqliteStore) Runs() ([]syncStats, error) {
+	// Runs allocated by NextRun, but not saved yet, have no start.
+	rows, err := s.db.Query(`SELECT data FROM runs WHERE start IS NOT NULL ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs []syncStats
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var r syncStats
+		if err := json.Unmarshal([]byte(data), &r); err != nil {
+			return nil, err
+		}
+		runs = append(runs, r)
+	}
+	return runs, rows.Err()
+}
+
+func (s *sqliteStore) RecentRuns(fn func(r *syncStats) bool) error {
+	// Rows are read as they're needed, so stopping early doesn't load the rest.
+	rows, err := s.db.Query(`SELECT data FROM runs WHERE start IS NOT NULL ORDER BY id DESC`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return err
+		}
+		var r syncStats
+		if err := json.Unmarshal([]byte(data), &r); err != nil {
+			return err
+		}
+		if !fn(&r) {
+			return nil
+		}
+	}
+	return rows.Err()
+}
+
+func (s *sqliteStore) Prune(id uint64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM runs WHERE id < ?`, int64(id)); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM actions WHERE run < ?`, int64(id)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func addSqliteEntry(ex execer, e *entry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = ex.Exec(`INSERT INTO actions (run, time, action, name, xid, uuid, error, data)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, int64(e.Run), fmtTime(e.Time), e.Action, e.Name,
+		int64(e.Xid), e.Uuid, e.Error, string(data))
+	return err
+}
+
+func (s *sqliteStore) AddEntry(e *entry) error {
+	return addSqliteEntry(s.db, e)
+}
+
+func (s *sqliteStore) Entries(keep func(e *entry) bool) ([]*entry, error) {
+	rows, err := s.db.Query(`SELECT data FROM actions ORDER BY seq`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []*entry
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		e := new(entry)
+		if err := json.Unmarshal([]byte(data), e); err != nil {
+			return nil, err
+		}
+		if keep(e) {
+			entries = append(entries, e)
+		}
+	}
+	return entries, rows.Err()
+}
+
+func (s *sqliteStore) Held() (map[string]*held, error) {
+	rows, err := s.db.Query(`SELECT data FROM quarantine`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(map[string]*held)
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		h := new(held)
+		if err := json.Unmarshal([]byte(data), h); err != nil {
+			return nil, err
+		}
+		result[h.Key] = h
+	}
+	return result, rows.Err()
+}
+
+func putSqliteHeld(ex execer, hs []*held) error {
+	for _, h := range hs {
+		data, err := json.Marshal(h)
+		if err != nil {
+			return err
+		}
+		if _, err := ex.Exec(`INSERT OR REPLACE INTO quarantine (key, state, data)
+			VALUES (?, ?, ?)`, h.Key, h.State, string(data)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqliteStore) PutHeld(hs ...*held) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		return putSqliteHeld(tx, hs)
+	})
+}
+
+func (s *sqliteStore) DeleteHeld(keys ...string) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		for _, k := range keys {
+			if _, err := tx.Exec(`DELETE FROM quarantine WHERE key = ?`, k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *sqliteStore) Intents() ([]*intent, error) {
+	rows, err := s.db.Query(`SELECT data FROM intents`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ins []*intent
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		in := new(intent)
+		if err := json.Unmarshal([]byte(data), in); err != nil {
+			return nil, err
+		}
+		ins = append(ins, in)
+	}
+	return ins, rows.Err()
+}
+
+func (s *sqliteStore) PutIntent(in *intent) error {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT OR REPLACE INTO intents (key, action, data) VALUES (?, ?, ?)`,
+		in.Key, in.Action, string(data))
+	return err
+}
+
+func (s *sqliteStore) DeleteIntent(key string) error {
+	_, err := s.db.Exec(`DELETE FROM intents WHERE key = ?`, key)
+	return err
+}
+
+func (s *sqliteStore) Reset() error {
+	_, err := s.db.Exec(`DELETE FROM mappings`)
+	return err
+}
+
+func (s *sqliteStore) Replace(st *state) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		for _, table := range []string{"mappings", "runs", "actions", "quarantine", "intents"} {
+			if _, err := tx.Exec(`DELETE FROM ` + table); err != nil {
+				return err
+			}
+		}
+		for i := range st.Mappings {
+			if err := putSqliteMapping(tx, &st.Mappings[i]); err != nil {
+				return err
+			}
+		}
+		for i := range st.Runs {
+			if err := saveSqliteRun(tx, &st.Runs[i]); err != nil {
+				return err
+			}
+		}
+		for _, e := range st.Actions {
+			if err := addSqliteEntry(tx, e); err != nil {
+				return err
+			}
+		}
+		return putSqliteHeld(tx, st.Quarantine)
+	})
+}
+
+func (s *sqliteStore) LoadOAuth() (*asana.OAuthToken, error) {
+	var data string
+	err := s.db.QueryRow(`SELECT data FROM oauth WHERE id = 1`).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "LoadOAuth")
+	}
+	t := new(asana.OAuthToken)
+	return t, errors.Wrap(json.Unmarshal([]byte(data), t), "LoadOAuth")
+}
+
+func (s *sqliteStore) SaveOAuth(t *asana.OAuthToken) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT OR REPLACE INTO oauth (id, data) VALUES (1, ?)`, string(data))
+	return err
+}
+
+func (s *sqliteStore) DeleteOAuth() error {
+	_, err := s.db.Exec(`DELETE FROM oauth`)
+	return err
+}
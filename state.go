@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/manishrjain/asanawarrior/asana"
+	"github.com/manishrjain/asanawarrior/taskwarrior"
+	"github.com/pkg/errors"
+)
+
+// state is the portable form of the sync state, for backups and moving to another machine. The
+// OAuth token isn't part of it.
+type state struct {
+	Version    int              `json:"version"` // Db schema version.
+	Exported   time.Time        `json:"exported"`
+	Workspace  string           `json:"workspace"`
+	Mappings   []mapping        `json:"mappings"`
+	Runs       []syncStats      `json:"runs"`
+	Actions    []*entry         `json:"actions"`
+	Quarantine []*held          `json:"quarantine,omitempty"`
+	Cache      asana.CacheState `json:"cache"` // For reference. Always refreshed from Asana.
+}
+
+// runExport writes the sync state as JSON to the file given.
+func runExport(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("Specify the file to export to")
+	}
+
+	s := state{Version: schemaVersion, Exported: time.Now(), Workspace: asana.Domain()}
+	var err error
+	if s.Mappings, err = db.Mappings(); err != nil {
+		return errors.Wrap(err, "Mappings")
+	}
+	if s.Runs, err = db.Runs(); err != nil {
+		return errors.Wrap(err, "Runs")
+	}
+	if s.Actions, err = db.Entries(func(e *entry) bool { return true }); err != nil {
+		return errors.Wrap(err, "Entries")
+	}
+	hs, err := db.Held()
+	if err != nil {
+		return errors.Wrap(err, "Held")
+	}
+	for _, h := range hs {
+		s.Quarantine = append(s.Quarantine, h)
+	}
+	if err := asana.Refresh(ctx); err != nil {
+		return errors.Wrap(err, "asana.Refresh")
+	}
+	s.Cache = asana.Cached()
+
+	out, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(fs.Arg(0), out, 0600); err != nil {
+		return err
+	}
+	fmt.Printf("Exported %d tasks, %d runs and %d actions to %v.\n",
+		len(s.Mappings), len(s.Runs), len(s.Actions), fs.Arg(0))
+	return nil
+}
+
+// validateState checks the state against the current Asana and Taskwarrior tasks, and returns
+// the problems found.
+func validateState(ctx context.Context, s *state) ([]string, error) {
+	var problems []string
+	if s.Workspace != asana.Domain() {
+		problems = append(problems, fmt.Sprintf("Exported from workspace %q, but using %q",
+			s.Workspace, asana.Domain()))
+	}
+
+	atasks, err := asana.GetTasks(ctx)
+	if _, ok := err.(*asana.FetchError); err != nil && !ok {
+		return nil, errors.Wrap(err, "asana.GetTasks")
+	} else if err != nil {
+		problems = append(problems, err.Error())
+	}
+	twtasks, err := taskwarrior.GetTasks()
+	if err != nil {
+		return nil, errors.Wrap(err, "taskwarrior.GetTasks")
+	}
+	inAsana := make(map[uint64]bool)
+	for _, at := range atasks {
+		inAsana[at.Xid] = true
+	}
+	twXid := make(map[string]uint64)
+	for _, t := range twtasks {
+		twXid[t.Uuid] = t.Xid
+	}
+
+	seenXid := make(map[uint64]bool)
+	seenUuid := make(map[string]bool)
+	for _, mp := range s.Mappings {
+		if seenXid[mp.Xid] || seenUuid[mp.Uuid] {
+			problems = append(problems, fmt.Sprintf("Task %d %v mapped more than once", mp.Xid,
+				mp.Uuid))
+		}
+		seenXid[mp.Xid], seenUuid[mp.Uuid] = true, true
+
+		xid, ok := twXid[mp.Uuid]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("Taskwarrior task %v not found", mp.Uuid))
+		case xid > 0 && xid != mp.Xid:
+			problems = append(problems, fmt.Sprintf("Taskwarrior task %v linked to %d, not %d",
+				mp.Uuid, xid, mp.Xid))
+		}
+		if !inAsana[mp.Xid] && (mp.Last.Asana == nil || !mp.Last.Asana.Modified.IsZero()) {
+			// Tasks deleted from Asana are expected to be missing.
+			problems = append(problems, fmt.Sprintf("Asana task %d not found", mp.Xid))
+		}
+	}
+	return problems, nil
+}
+
+// runImport replaces the sync state with the one exported to the file given.
+func runImport(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	force := fs.Bool("force", false, "Import even if the state doesn't match Asana or Taskwarrior.")
+	dryRun := fs.Bool("dry-run", false, "Only validate the state.")
+	yes := fs.Bool("yes", false, "Don't ask for confirmation.")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("Specify the file to import")
+	}
+
+	data, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	var s state
+	if err := json.Unmarshal(data, &s); err != nil {
+		return errors.Wrap(err, "Invalid state file")
+	}
+	if s.Version != schemaVersion {
+		return fmt.Errorf("State exported with db schema version %d. Expected %d", s.Version,
+			schemaVersion)
+	}
+
+	problems, err := validateState(ctx, &s)
+	if err != nil {
+		return err
+	}
+	for _, p := range problems {
+		fmt.Printf("[WARN] %s\n", p)
+	}
+	fmt.Printf("%d tasks, %d runs, %d actions and %d quarantined deletions. %d problems found.\n",
+		len(s.Mappings), len(s.Runs), len(s.Actions), len(s.Quarantine), len(problems))
+	if *dryRun {
+		return nil
+	}
+	if len(problems) > 0 && !*force {
+		return errors.New("Not importing due to problems. Use -force to import anyway")
+	}
+	if !*yes && !confirm(fmt.Sprintf("Replace the sync state stored in %v?", *dbpath)) {
+		fmt.Println("Aborted.")
+		return nil
+	}
+
+	backup, err := db.Backup()
+	if err != nil {
+		return err
+	}
+	if err := db.Replace(&s); err != nil {
+		return errors.Wrap(err, "Unable to import state")
+	}
+	fmt.Printf("Sync state imported. Previous db saved at %v.\n", backup)
+	return nil
+}
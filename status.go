@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func printStats(s *syncStats) {
+	fmt.Printf("Last sync started at %v, took %v. Tasks seen: %d.\n",
+		s.Start.Format(time.RFC1123), s.End.Sub(s.Start), s.Matches)
+	var names []string
+	for name := range s.Actions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("%27s: %d\n", name, s.Actions[name])
+	}
+	if s.Quarantined > 0 {
+		fmt.Printf("%d deletions in quarantine. See the quarantine command.\n", s.Quarantined)
+	}
+	if len(s.Errors) > 0 {
+		fmt.Printf("%d errors:\n", len(s.Errors))
+		for _, e := range s.Errors {
+			fmt.Printf("\t%s\n", e)
+		}
+	}
+}
+
+// runStatus shows the results of the last sync, along with the changes the next sync would
+// make, and any conflicts where the task was modified in both Asana and Taskwarrior.
+func runStatus(ctx context.Context, args []string) error {
+	s, err := lastRun()
+	if err != nil {
+		return errors.Wrap(err, "lastRun")
+	}
+	if s == nil {
+		fmt.Println("No sync has been run yet.")
+	} else {
+		printStats(s)
+	}
+
+	ins, err := db.Intents()
+	if err != nil {
+		return errors.Wrap(err, "Intents")
+	}
+	if len(ins) > 0 {
+		fmt.Printf("%d actions left unfinished by an earlier sync. The next sync tries to resolve them.\n",
+			len(ins))
+	}
+
+	fmt.Println()
+	// Read only. The daemon may be syncing.
+	matches, err := fetchMatches(ctx, false)
+	if err != nil {
+		return err
+	}
+	var pending, conflicts int
+	for _, m := range matches {
+		act, err := planMatch(m)
+		if err != nil {
+			fmt.Printf("%27s: [%q] %v\n", "ERROR", m.TaskWr.Name, err)
+			continue
+		}
+		if act == actNone {
+			continue
+		}
+		pending++
+		name := m.Asana.Name
+		if m.Xid == 0 {
+			name = m.TaskWr.Name
+		}
+		if conflict(m) {
+			conflicts++
+			fmt.Printf("%27s: [%q] modified in both, Asana wins\n", "CONFLICT", name)
+			continue
+		}
+		fmt.Printf("%27s: [%q]\n", act, name)
+	}
+	fmt.Printf("\n%d changes pending, %d conflicts.\n", pending, conflicts)
+	return nil
+}
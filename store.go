@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/manishrjain/asanawarrior/asana"
+)
+
+var storeKind = flag.String("store", "bolt",
+	"Where to keep the sync state: bolt or sqlite. Use a different -db path for each.")
+
+// store keeps the sync state: the links between Asana and Taskwarrior tasks, the journal of sync
+// runs, deletions in quarantine and the OAuth token.
+type store interface {
+	asana.TokenStore
+
+	// GetMapping returns the mapping of Asana task xid, or nil if there's none.
+	GetMapping(xid uint64) (*mapping, error)
+	// PutMapping stores mp, replacing any previous links of its Asana or Taskwarrior task.
+	PutMapping(mp *mapping) error
+	// DeleteMapping forgets any links of the Asana task xid, and the Taskwarrior task uuid.
+	DeleteMapping(xid uint64, uuid string) error
+	Mappings() ([]mapping, error)
+
+	// NextRun allocates an id for a new sync run.
+	NextRun() (uint64, error)
+	SaveRun(s *syncStats) error
+	// Runs returns all sync runs, in the order they were started.
+	Runs() ([]syncStats, error)
+	// RecentRuns calls fn with the sync runs, the most recent first, until it returns false.
+	RecentRuns(fn func(r *syncStats) bool) error
+	// Prune forgets the sync runs before run id, and their journal entries.
+	Prune(id uint64) error
+	AddEntry(e *entry) error
+	// Entries returns all journal entries for which keep returns true, in the order they were
+	// recorded.
+	Entries(keep func(e *entry) bool) ([]*entry, error)
+
+	Held() (map[string]*held, error)
+	PutHeld(hs ...*held) error
+	DeleteHeld(keys ...string) error
+
+	Intents() ([]*intent, error)
+	PutIntent(in *intent) error
+	DeleteIntent(key string) error
+
+	// Migrate brings the store to the current schema version.
+	Migrate() error
+	// Version returns the schema version of the store.
+	Version() (int, error)
+	// Backup copies the store next to it, and returns the path of the copy.
+	Backup() (string, error)
+	// Reset forgets all links, and so the last synced state of all tasks.
+	Reset() error
+	// Replace replaces the sync state with s.
+	Replace(s *state) error
+	// Suspend closes the store until Resume, so other processes can open it meanwhile. The
+	// daemon suspends it between syncs.
+	Suspend() error
+	Resume() error
+	Close() error
+}
+
+func openStore(path string) (store, error) {
+	switch *storeKind {
+	case "bolt":
+		return openBolt(path)
+	case "sqlite":
+		return openSqlite(path)
+	}
+	return nil, fmt.Errorf("Unknown store: %q. Should be bolt or sqlite", *storeKind)
+}
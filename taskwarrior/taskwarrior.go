@@ -8,6 +8,7 @@ import (
 	"os/exec"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/manishrjain/asanawarrior/x"
@@ -16,30 +17,118 @@ import (
 
 const (
 	stamp = "20060102T150405Z"
+
+	// watchTag marks the tasks being followed in Asana, without being assigned to them.
+	watchTag = "watching"
+
+	// noHooks keeps our own changes from running the Taskwarrior hooks, which would sync them
+	// back to Asana.
+	noHooks = "rc.hooks=off"
 )
 
 type task struct {
 	Completed   string   `json:"end,omitempty"`
 	Created     string   `json:"entry,omitempty"`
+	Depends     uuidList `json:"depends,omitempty"`
 	Description string   `json:"description,omitempty"`
+	Followers   string   `json:"followers,omitempty"`
 	Modified    string   `json:"modified,omitempty"`
+	Priority    string   `json:"priority,omitempty"`
 	Project     string   `json:"project,omitempty"`
+	Started     string   `json:"start,omitempty"`
 	Status      string   `json:"status,omitempty"`
 	Tags        []string `json:"tags,omitempty"`
 	Uuid        string   `json:"uuid,omitempty"`
 	Xid         string   `json:"xid,omitempty"`
+
+	// Attrs holds all other attributes and UDAs with string or numeric values.
+	Attrs map[string]string `json:"-"`
 }
 
-var uuidExp *regexp.Regexp
+// taskAlias avoids recursion when (un)marshalling task.
+type taskAlias task
 
-func init() {
-	var err error
-	uuidExp, err = regexp.Compile("([0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{8})")
-	if err != nil {
-		log.Fatalf("regexp compile error: %v", err)
+// internal are keys which either map to fields in task, or which we never want to sync.
+var internal = map[string]bool{
+	"description": true, "end": true, "entry": true, "depends": true, "followers": true,
+	"id": true, "modified": true, "priority": true, "project": true, "start": true,
+	"status": true, "tags": true, "urgency": true, "uuid": true, "xid": true,
+}
+
+func (t *task) UnmarshalJSON(b []byte) error {
+	var a taskAlias
+	if err := json.Unmarshal(b, &a); err != nil {
+		return err
 	}
+	var all map[string]interface{}
+	if err := json.Unmarshal(b, &all); err != nil {
+		return err
+	}
+	*t = task(a)
+	for k, v := range all {
+		if internal[k] {
+			continue
+		}
+		if t.Attrs == nil {
+			t.Attrs = make(map[string]string)
+		}
+		switch val := v.(type) {
+		case string:
+			t.Attrs[k] = val
+		case float64:
+			t.Attrs[k] = strconv.FormatFloat(val, 'f', -1, 64)
+		}
+	}
+	return nil
 }
 
+func (t task) MarshalJSON() ([]byte, error) {
+	body, err := json.Marshal(taskAlias(t))
+	if err != nil || len(t.Attrs) == 0 {
+		return body, err
+	}
+	var all map[string]interface{}
+	if err := json.Unmarshal(body, &all); err != nil {
+		return nil, err
+	}
+	for k, v := range t.Attrs {
+		if !internal[k] && len(v) > 0 {
+			all[k] = v
+		}
+	}
+	return json.Marshal(all)
+}
+
+// uuidList holds the UUIDs a task depends on. Taskwarrior exports them either as a
+// comma separated string, or as a JSON array depending upon the version.
+type uuidList []string
+
+func (l *uuidList) UnmarshalJSON(b []byte) error {
+	var list []string
+	if err := json.Unmarshal(b, &list); err == nil {
+		*l = list
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	*l = (*l)[:0]
+	for _, u := range strings.Split(s, ",") {
+		if u = strings.TrimSpace(u); len(u) > 0 {
+			*l = append(*l, u)
+		}
+	}
+	return nil
+}
+
+func (l uuidList) MarshalJSON() ([]byte, error) {
+	return json.Marshal(strings.Join(l, ","))
+}
+
+var uuidExp = regexp.MustCompile(
+	"([0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{8})")
+
 func (t task) ToWarriorTask() (x.WarriorTask, error) {
 	var empty x.WarriorTask
 	mts, err := time.Parse(stamp, t.Modified)
@@ -57,13 +146,25 @@ func (t task) ToWarriorTask() (x.WarriorTask, error) {
 			return empty, err
 		}
 	}
+	var sts time.Time
+	if len(t.Started) > 0 {
+		sts, err = time.Parse(stamp, t.Started)
+		if err != nil {
+			return empty, err
+		}
+	}
 
 	var ass, sec string
 	var tags []string
+	var watching bool
 	for _, tg := range t.Tags {
 		if len(tg) == 0 {
 			continue
 		}
+		if tg == watchTag {
+			watching = true
+			continue
+		}
 		switch tg[0] {
 		case '@':
 			ass = tg[1:]
@@ -84,13 +185,23 @@ func (t task) ToWarriorTask() (x.WarriorTask, error) {
 		Created:  cts,
 		Modified: mts,
 		Name:     t.Description,
+		Priority: t.Priority,
 		Project:  t.Project,
 		Section:  sec,
+		Started:  sts,
 		Tags:     tags,
 		Xid:      xid,
 		Uuid:     t.Uuid,
+		Watching: watching,
+		Fields:   t.Attrs,
 		Deleted:  t.Status == "deleted",
 	}
+	if len(t.Followers) > 0 {
+		wt.Followers = strings.Split(t.Followers, ",")
+	}
+	if len(t.Depends) > 0 {
+		wt.DependsUuid = append(wt.DependsUuid, t.Depends...)
+	}
 	if !dts.IsZero() {
 		wt.Completed = dts
 	}
@@ -100,9 +211,9 @@ func (t task) ToWarriorTask() (x.WarriorTask, error) {
 func getTasks(filter string) ([]task, error) {
 	var cmd *exec.Cmd
 	if len(filter) > 0 {
-		cmd = exec.Command("task", filter, "export")
+		cmd = exec.Command("task", noHooks, filter, "export")
 	} else {
-		cmd = exec.Command("task", "export")
+		cmd = exec.Command("task", noHooks, "export")
 	}
 
 	var out bytes.Buffer
@@ -137,7 +248,7 @@ func GetTasks() ([]x.WarriorTask, error) {
 }
 
 func generateTags(wt x.WarriorTask) []string {
-	tags := make([]string, len(wt.Tags), len(wt.Tags)+2)
+	tags := make([]string, len(wt.Tags), len(wt.Tags)+3)
 	copy(tags, wt.Tags)
 
 	if len(wt.Assignee) > 0 {
@@ -146,6 +257,9 @@ func generateTags(wt x.WarriorTask) []string {
 	if len(wt.Section) > 0 {
 		tags = append(tags, "_"+wt.Section)
 	}
+	if wt.Watching {
+		tags = append(tags, watchTag)
+	}
 	return tags
 }
 
@@ -158,15 +272,22 @@ func createNew(wt x.WarriorTask) task {
 
 	t := task{
 		Created:     wt.Created.Format(stamp),
+		Depends:     wt.DependsUuid,
 		Description: wt.Name,
+		Followers:   strings.Join(wt.Followers, ","),
+		Priority:    wt.Priority,
 		Project:     wt.Project,
 		Status:      status,
 		Tags:        tags,
 		Xid:         strconv.FormatUint(wt.Xid, 10),
+		Attrs:       wt.Fields,
 	}
 	if !wt.Completed.IsZero() {
 		t.Completed = wt.Completed.Format(stamp)
 	}
+	if !wt.Started.IsZero() {
+		t.Started = wt.Started.Format(stamp)
+	}
 	return t
 }
 
@@ -177,7 +298,7 @@ func doImport(t task) (string, error) {
 		return "", err
 	}
 
-	cmd := fmt.Sprintf("echo -n %q | task import", body)
+	cmd := fmt.Sprintf("echo -n %q | task %s import", body, noHooks)
 	// fmt.Println(cmd)
 	out, err := exec.Command("bash", "-c", cmd).Output()
 	if err != nil {
@@ -207,13 +328,52 @@ func Delete(prev x.WarriorTask) error {
 	return err
 }
 
+// Restore re-imports a previous state of the task, as returned by GetTask.
+func Restore(prev x.WarriorTask) error {
+	t := createNew(prev)
+	t.Uuid = prev.Uuid
+	if prev.Xid == 0 {
+		t.Xid = ""
+	}
+	if prev.Deleted {
+		if len(t.Completed) == 0 {
+			t.Completed = time.Now().Format(stamp)
+		}
+		t.Status = "deleted"
+	}
+	_, err := doImport(t)
+	return err
+}
+
 func GetTask(uuid string) (x.WarriorTask, error) {
 	tasks, err := getTasks(uuid)
 	if err != nil {
 		return x.WarriorTask{}, errors.Wrapf(err, "taskwarrior GetTask")
 	}
+	if len(tasks) == 0 {
+		return x.WarriorTask{}, x.Errorf(x.NotFound, "No task matching UUID: %v", uuid)
+	}
 	if len(tasks) > 1 {
-		log.Fatalf("Multiple tasks matching a UUID: %+v", tasks)
+		return x.WarriorTask{}, x.Errorf(x.Corrupt, "Multiple tasks matching UUID: %v", uuid)
 	}
 	return tasks[0].ToWarriorTask()
 }
+
+// Version returns the version of Taskwarrior installed.
+func Version() (string, error) {
+	out, err := exec.Command("task", "--version").Output()
+	if err != nil {
+		return "", errors.Wrap(err, "task --version")
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// UdaType returns the type of UDA name, as configured in Taskwarrior. It's empty if the UDA
+// hasn't been defined.
+func UdaType(name string) (string, error) {
+	out, err := exec.Command("task", "_get", "rc.uda."+name+".type").Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "task _get uda %v", name)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/manishrjain/asanawarrior/asana"
+	"github.com/manishrjain/asanawarrior/taskwarrior"
+	"github.com/manishrjain/asanawarrior/x"
+	"github.com/pkg/errors"
+)
+
+// undoStep reverts a single journaled action. If apply returns both the Asana and Taskwarrior
+// tasks, they're considered in sync. Otherwise, the next sync picks up the restored state.
+type undoStep struct {
+	e     *entry
+	desc  string
+	apply func() (asanaTask, twTask x.WarriorTask, err error)
+}
+
+// restoreAsana brings the Asana task back to its state in before. If the task no longer exists,
+// it gets re-created.
+func restoreAsana(ctx context.Context, before x.WarriorTask) (x.WarriorTask, error) {
+	cur, err := asana.GetOneTask(ctx, before.Xid)
+	if x.KindOf(err) == x.NotFound {
+		// Task is gone. Re-create it.
+		return asana.AddNew(ctx, before, nil)
+	}
+	if err != nil {
+		return x.WarriorTask{}, errors.Wrap(err, "GetOneTask")
+	}
+	if err := asana.UpdateTask(ctx, before, cur); err != nil {
+		return x.WarriorTask{}, err
+	}
+	return asana.GetOneTask(ctx, before.Xid)
+}
+
+// restoreTaskw re-imports the task in its state in before, linked to Asana task xid. If xid is
+// zero, the task is unlinked.
+func restoreTaskw(before x.WarriorTask, xid uint64) (x.WarriorTask, error) {
+	if xid == 0 {
+		// Forget the link in the db as well. Otherwise, the next sync relinks the task from it.
+		if err := db.DeleteMapping(before.Xid, before.Uuid); err != nil {
+			return x.WarriorTask{}, errors.Wrap(err, "DeleteMapping")
+		}
+	}
+	before.Xid = xid
+	if err := taskwarrior.Restore(before); err != nil {
+		return x.WarriorTask{}, err
+	}
+	return taskwarrior.GetTask(before.Uuid)
+}
+
+// restoredTaskw returns the state to restore the Taskwarrior task to, to undo the action in e.
+func restoredTaskw(e *entry) x.WarriorTask {
+	tt := *e.Before.Taskw
+	if e.Action == actDeleteAsana.String() {
+		// Deleting the task in Taskwarrior is what deleted it from Asana. Undo that as well, so
+		// the next sync doesn't delete it again. It's pending, unless completed in Asana.
+		tt.Deleted = false
+		tt.Completed = e.Before.Asana.Completed
+	}
+	return tt
+}
+
+// planUndo figures out how to revert the action recorded in e. Returns nil if it can't be
+// reverted.
+func planUndo(ctx context.Context, e *entry) *undoStep {
+	b, a := e.Before, e.After
+	s := &undoStep{e: e}
+	switch e.Action {
+	case actOverwriteTaskw.String(), actDeleteTaskw.String():
+		if b.Taskw == nil {
+			return nil
+		}
+		xid := b.Taskw.Xid
+		s.desc = "Restore in Taskwarrior, to be pushed to Asana on the next sync"
+		if e.Action == actDeleteTaskw.String() {
+			// The Asana task is gone. Unlink it, so it gets re-created in Asana on the next sync.
+			xid = 0
+			s.desc = "Restore in Taskwarrior, to be re-created in Asana on the next sync"
+		}
+		s.apply = func() (x.WarriorTask, x.WarriorTask, error) {
+			tt, err := restoreTaskw(*b.Taskw, xid)
+			return x.WarriorTask{}, tt, err
+		}
+
+	case actOverwriteAsana.String(), actDeleteAsana.String(), actSyncDepends.String():
+		if b.Asana == nil || b.Taskw == nil {
+			return nil
+		}
+		s.desc = "Restore previous state in Asana and Taskwarrior"
+		if e.Action == actDeleteAsana.String() {
+			s.desc = "Restore or re-create in Asana, and undelete in Taskwarrior"
+		}
+		s.apply = func() (x.WarriorTask, x.WarriorTask, error) {
+			at, err := restoreAsana(ctx, *b.Asana)
+			if err != nil {
+				return at, x.WarriorTask{}, errors.Wrap(err, "restoreAsana")
+			}
+			tt, err := restoreTaskw(restoredTaskw(e), at.Xid)
+			return at, tt, err
+		}
+
+	case actCreateAsana.String():
+		if a.Asana == nil || b.Taskw == nil {
+			return nil
+		}
+		s.desc = "Delete from Asana. Modify or delete in Taskwarrior to avoid re-creation"
+		s.apply = func() (x.WarriorTask, x.WarriorTask, error) {
+			if err := asana.Delete(ctx, a.Asana.Xid); err != nil {
+				return x.WarriorTask{}, x.WarriorTask{}, errors.Wrap(err, "asana.Delete")
+			}
+			tt, err := restoreTaskw(*b.Taskw, 0)
+			return x.WarriorTask{}, tt, err
+		}
+
+	case actCreateTaskw.String():
+		if a.Taskw == nil || b.Asana == nil {
+			return nil
+		}
+		s.desc = "Delete from Taskwarrior, leaving Asana as is"
+		s.apply = func() (x.WarriorTask, x.WarriorTask, error) {
+			if err := taskwarrior.Delete(*a.Taskw); err != nil {
+				return x.WarriorTask{}, x.WarriorTask{}, errors.Wrap(err, "taskwarrior.Delete")
+			}
+			tt, err := taskwarrior.GetTask(a.Taskw.Uuid)
+			if err != nil {
+				return x.WarriorTask{}, tt, err
+			}
+			at, err := asana.GetOneTask(ctx, b.Asana.Xid)
+			return at, tt, err
+		}
+
+	default:
+		return nil
+	}
+	return s
+}
+
+// wasUndone returns true if run id has already been undone. Undo runs always come after the run
+// they undo.
+func wasUndone(id uint64) (bool, error) {
+	var undone bool
+	err := db.RecentRuns(func(r *syncStats) bool {
+		if r.Undo == id {
+			undone = true
+		}
+		return !undone && r.Id > id
+	})
+	return undone, err
+}
+
+// lastUndoable returns the id of the latest run which applied some actions, and which isn't an
+// undo itself, or has already been undone.
+func lastUndoable() (uint64, error) {
+	undone := make(map[uint64]bool)
+	var id uint64
+	err := db.RecentRuns(func(r *syncStats) bool {
+		if r.Undo > 0 {
+			undone[r.Undo] = true
+			return true
+		}
+		if len(r.Actions) == 0 || undone[r.Id] {
+			return true
+		}
+		id = r.Id
+		return false
+	})
+	if err != nil {
+		return 0, err
+	}
+	if id == 0 {
+		return 0, errors.New("No sync run found to undo")
+	}
+	return id, nil
+}
+
+// runUndo reverts the actions applied by a sync run, in the reverse order they were applied.
+func runUndo(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("undo", flag.ExitOnError)
+	run := fs.Uint64("run", 0, "Id of the sync run to undo. Defaults to the last run with changes.")
+	dryRun := fs.Bool("dry-run", false, "Only show what would be reverted.")
+	yes := fs.Bool("yes", false, "Don't ask for confirmation.")
+	force := fs.Bool("force", false, "Undo the run, even if it was already undone.")
+	fs.Parse(args)
+
+	id := *run
+	if id == 0 {
+		var err error
+		if id, err = lastUndoable(); err != nil {
+			return err
+		}
+	}
+	undone, err := wasUndone(id)
+	if err != nil {
+		return err
+	}
+	if undone && !*force {
+		return fmt.Errorf("Run %d has already been undone. Use -force to undo again", id)
+	}
+
+	entries, err := db.Entries(func(e *entry) bool {
+		return e.Run == id && len(e.Error) == 0
+	})
+	if err != nil {
+		return err
+	}
+	var steps []*undoStep
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if s := planUndo(ctx, e); s != nil {
+			steps = append(steps, s)
+		} else {
+			fmt.Printf("Can't undo %s of [%q]. Skipping.\n", e.Action, e.Name)
+		}
+	}
+	if len(steps) == 0 {
+		fmt.Printf("Nothing to undo for run %d.\n", id)
+		return nil
+	}
+
+	fmt.Printf("Undo run %d:\n", id)
+	for _, s := range steps {
+		fmt.Printf("%27s: [%q] %s\n", s.e.Action, s.e.Name, s.desc)
+	}
+	if *dryRun {
+		return nil
+	}
+	if err := lockInstance(); err != nil {
+		return err
+	}
+	if !*yes && !confirm(fmt.Sprintf("Revert these %d actions?", len(steps))) {
+		fmt.Println("Aborted.")
+		return nil
+	}
+
+	if err := asana.Refresh(ctx); err != nil {
+		return errors.Wrap(err, "asana.Refresh")
+	}
+	stats := &syncStats{Id: startRun(), Start: time.Now(), Undo: id,
+		Actions: make(map[string]int)}
+	for _, s := range steps {
+		e := &entry{
+			Run:    stats.Id,
+			Time:   time.Now(),
+			Action: "undo-" + s.e.Action,
+			Name:   s.e.Name,
+			Xid:    s.e.Xid,
+			Uuid:   s.e.Uuid,
+			Before: s.e.After,
+		}
+		at, tt, err := s.apply()
+		e.After = snapshot{Asana: present(at), Taskw: present(tt)}
+		if err != nil {
+			fmt.Printf("Unable to undo %s of [%q]: %v\n", s.e.Action, s.e.Name, err)
+			e.Error = err.Error()
+			stats.Errors = append(stats.Errors, err.Error())
+		} else {
+			stats.Actions[e.Action]++
+			if at.Xid > 0 && len(tt.Uuid) > 0 {
+				// So the next sync doesn't consider the restored state as a modification.
+				if err := storeInDb(at, tt); err != nil {
+					fmt.Printf("Unable to store sync state of [%q]: %v\n", s.e.Name, err)
+				}
+			}
+		}
+		journalAction(e)
+	}
+	stats.End = time.Now()
+	saveStats(stats)
+	fmt.Printf("Reverted %d of %d actions.\n", len(steps)-len(stats.Errors), len(steps))
+	return nil
+}
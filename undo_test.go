@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/manishrjain/asanawarrior/x"
+)
+
+func TestRestoredTaskw(t *testing.T) {
+	done := time.Date(2017, 3, 1, 10, 0, 0, 0, time.UTC)
+	deleted := x.WarriorTask{Xid: 1, Uuid: "u1", Name: "a", Deleted: true, Completed: done}
+	pending := x.WarriorTask{Xid: 1, Uuid: "u1", Name: "a"}
+	tests := []struct {
+		name  string
+		act   action
+		asana x.WarriorTask
+		taskw x.WarriorTask
+		want  x.WarriorTask
+	}{
+		{"delete asana", actDeleteAsana, x.WarriorTask{Xid: 1, Name: "a"}, deleted, pending},
+		{"delete completed asana", actDeleteAsana, x.WarriorTask{Xid: 1, Name: "a",
+			Completed: done}, deleted, x.WarriorTask{Xid: 1, Uuid: "u1", Name: "a",
+			Completed: done}},
+		{"overwrite asana", actOverwriteAsana, x.WarriorTask{Xid: 1, Name: "b"}, pending, pending},
+		{"sync depends", actSyncDepends, x.WarriorTask{Xid: 1, Name: "a"}, pending, pending},
+	}
+	for _, tt := range tests {
+		asana, taskw := tt.asana, tt.taskw
+		e := &entry{Action: tt.act.String(), Before: snapshot{Asana: &asana, Taskw: &taskw}}
+		got := restoredTaskw(e)
+		if got.Deleted != tt.want.Deleted || !got.Completed.Equal(tt.want.Completed) ||
+			got.Name != tt.want.Name || got.Uuid != tt.want.Uuid {
+			t.Errorf("%s: restoredTaskw = %+v, want %+v", tt.name, got, tt.want)
+		}
+		if s := planUndo(context.Background(), e); s == nil {
+			t.Errorf("%s: planUndo = nil, want a step", tt.name)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+)
+
+// taskLocks serialises operations on the same task, which can be reached either by its Asana id
+// or by its Taskwarrior UUID.
+type taskLocks struct {
+	sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func (l *taskLocks) get(key string) *sync.Mutex {
+	l.Lock()
+	defer l.Unlock()
+	mu, ok := l.locks[key]
+	if !ok {
+		mu = new(sync.Mutex)
+		l.locks[key] = mu
+	}
+	return mu
+}
+
+// lock locks the tasks of match m, and returns the function to unlock them. The Asana task is
+// always locked before the Taskwarrior one, so workers can't deadlock.
+func (l *taskLocks) lock(m *Match) func() {
+	var held []*sync.Mutex
+	xid := m.Xid
+	if xid == 0 {
+		xid = m.TaskWr.Xid
+	}
+	if xid > 0 {
+		held = append(held, l.get("xid:"+strconv.FormatUint(xid, 10)))
+	}
+	if len(m.TaskWr.Uuid) > 0 {
+		held = append(held, l.get("uuid:"+m.TaskWr.Uuid))
+	}
+	for _, mu := range held {
+		mu.Lock()
+	}
+	return func() {
+		for i := len(held) - 1; i >= 0; i-- {
+			held[i].Unlock()
+		}
+	}
+}
+
+// syncMatches syncs the matches using up to -workers goroutines, and returns the deletions found
+// in the order of matches, for guardDeletes. No more matches are picked up once record returns
+// false or on shutdown, in which case stopped is true. Calls to record are serialised.
+func syncMatches(ctx context.Context, matches []*Match,
+	record func(m *Match, act action, err error) bool) (deletes []*Match, stopped bool) {
+
+	n := *workers
+	if n < 1 {
+		n = 1
+	}
+	locks := &taskLocks{locks: make(map[string]*sync.Mutex)}
+	deferred := make([]bool, len(matches))
+
+	var mu sync.Mutex // Guards record and stopped.
+	var wg sync.WaitGroup
+	idxs := make(chan int)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range idxs {
+				m := matches[i]
+				var dels []*Match
+				unlock := locks.lock(m)
+				act, err := syncMatch(ctx, m, &dels)
+				unlock()
+				deferred[i] = len(dels) > 0
+
+				mu.Lock()
+				if !record(m, act, err) {
+					stopped = true
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for i := range matches {
+		mu.Lock()
+		if shuttingDown() {
+			stopped = true
+		}
+		stop := stopped
+		mu.Unlock()
+		if stop {
+			break
+		}
+		idxs <- i
+	}
+	close(idxs)
+	wg.Wait()
+
+	for i, m := range matches {
+		if deferred[i] {
+			deletes = append(deletes, m)
+		}
+	}
+	return deletes, stopped
+}
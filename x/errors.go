@@ -0,0 +1,56 @@
+package x
+
+import "fmt"
+
+// Kind classifies errors from Asana, Taskwarrior and the db, so the sync can decide whether to
+// skip the task, retry later, or stop.
+type Kind int
+
+const (
+	Unknown     Kind = iota
+	NotFound         // The task or object doesn't exist.
+	Conflict         // Concurrent modification. Retry on the next sync.
+	RateLimited      // Too many requests. Back off until the next sync.
+	Auth             // Invalid or expired credentials.
+	Corrupt          // Unexpected or unparseable data.
+	Unavailable      // Server error. Retry on the next sync.
+)
+
+var kindNames = []string{"unknown", "not found", "conflict", "rate limited", "auth", "corrupt",
+	"unavailable"}
+
+func (k Kind) String() string {
+	return kindNames[k]
+}
+
+// Error is an error of a known Kind.
+type Error struct {
+	Kind Kind
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return e.Kind.String() + ": " + e.Msg
+}
+
+func Errorf(kind Kind, format string, args ...interface{}) error {
+	return &Error{Kind: kind, Msg: fmt.Sprintf(format, args...)}
+}
+
+// KindOf returns the Kind of err, looking through errors wrapped by github.com/pkg/errors.
+func KindOf(err error) Kind {
+	type causer interface {
+		Cause() error
+	}
+	for err != nil {
+		if e, ok := err.(*Error); ok {
+			return e.Kind
+		}
+		c, ok := err.(causer)
+		if !ok {
+			break
+		}
+		err = c.Cause()
+	}
+	return Unknown
+}
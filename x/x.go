@@ -6,14 +6,21 @@ type WarriorTask struct {
 	Assignee  string
 	Completed time.Time
 	Created   time.Time
+	Depends   []uint64          // Asana ids of tasks this task depends on.
+	Fields    map[string]string // Taskwarrior attributes, mapped to Asana custom fields.
+	Followers []string
 	Modified  time.Time
 	Name      string
+	Priority  string // H, M or L.
 	Project   string
 	Section   string
+	Started   time.Time
 	Tags      []string
 	Xid       uint64
 	Uuid      string
+	Watching  bool // Following the task, without being assigned to it.
 
 	// TaskWarrior
-	Deleted bool
+	Deleted     bool
+	DependsUuid []string
 }